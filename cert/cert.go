@@ -15,6 +15,12 @@ import (
 	"time"
 )
 
+// Provider issues the certificates presented to intercepted clients
+type Provider interface {
+	// GetCert returns a certificate valid for serverName
+	GetCert(serverName string) (*tls.Certificate, error)
+}
+
 // Cert Manager
 type Manager struct {
 	certBlock, keyBlock *pem.Block
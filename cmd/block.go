@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/proxy/block"
+)
+
+// block spec syntax, a url pattern followed by comma separated options
+const blockUsage = `block the requests matching a url pattern without contacting upstream, repeatable
+  PATTERN[,close|reset][,status=CODE][,header=NAME:VALUE]...[,filter=EXPR][,body=TEXT]
+blocked requests are answered 403 unless status is set, close and reset end the client conn instead,
+filter and body come last and may contain commas, e.g. *.analytics.example.com,status=204 or ads.example.com,reset`
+
+// parseBlock parses a block rule spec
+func parseBlock(spec string) (block.Rule, error) {
+	// the body takes the rest of the spec, and the filter the rest before the body
+	spec, body, hasBody := strings.Cut(spec, ",body=")
+	spec, expr, hasFilter := strings.Cut(spec, ",filter=")
+	fields := strings.Split(spec, ",")
+	if len(fields[0]) == 0 {
+		return block.Rule{}, fmt.Errorf("invalid block %q, want PATTERN[,options]", spec)
+	}
+
+	rule := block.Rule{URL: fields[0], Body: body}
+	if hasBody {
+		rule.Action = block.ActionRespond
+	}
+	if hasFilter {
+		var err error
+		if rule.Filter, err = filter.Parse(expr); err != nil {
+			return block.Rule{}, fmt.Errorf("block %s: %w", rule.URL, err)
+		}
+	}
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "close", "reset":
+			if len(rule.Action) > 0 {
+				return block.Rule{}, fmt.Errorf("block %s: %s conflicts with %s", rule.URL, name, rule.Action)
+			}
+			rule.Action = name
+		case "status":
+			code, err := strconv.Atoi(value)
+			if err != nil {
+				return block.Rule{}, fmt.Errorf("block %s: invalid status %q", rule.URL, value)
+			}
+			rule.Status = code
+		case "header":
+			k, v, ok := strings.Cut(value, ":")
+			if !ok {
+				return block.Rule{}, fmt.Errorf("block %s: invalid header %q, want NAME:VALUE", rule.URL, value)
+			}
+			if rule.Header == nil {
+				rule.Header = make(map[string]string)
+			}
+			rule.Header[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		default:
+			return block.Rule{}, fmt.Errorf("block %s: unknown option %q", rule.URL, name)
+		}
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/proxy/block"
+)
+
+func TestParseBlock(t *testing.T) {
+	tests := []struct {
+		spec   string
+		want   block.Rule
+		filter string
+	}{
+		{"ads.example.com", block.Rule{URL: "ads.example.com"}, ""},
+		{"ads.example.com,reset", block.Rule{URL: "ads.example.com", Action: block.ActionReset}, ""},
+		{"*.example.com,close", block.Rule{URL: "*.example.com", Action: block.ActionClose}, ""},
+		{
+			"example.com,status=204,header=X-Blocked: yes",
+			block.Rule{URL: "example.com", Status: 204, Header: map[string]string{"X-Blocked": "yes"}},
+			"",
+		},
+		{
+			"example.com,status=451,body=blocked, by policy",
+			block.Rule{URL: "example.com", Action: block.ActionRespond, Status: 451, Body: "blocked, by policy"},
+			"",
+		},
+		{
+			"example.com,filter=path:'^/(a,b)' method:GET",
+			block.Rule{URL: "example.com"},
+			"path:'^/(a,b)' method:GET",
+		},
+		{
+			"example.com,filter=path:x{1,2},body=no, really",
+			block.Rule{URL: "example.com", Action: block.ActionRespond, Body: "no, really"},
+			"path:x{1,2}",
+		},
+		{
+			"example.com,filter=header:X-A=a,b,body=x,filter=y",
+			block.Rule{URL: "example.com", Action: block.ActionRespond, Body: "x,filter=y"},
+			"header:X-A=a,b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseBlock(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.URL != tt.want.URL || got.Action != tt.want.Action || got.Status != tt.want.Status ||
+				got.Body != tt.want.Body || !maps.Equal(got.Header, tt.want.Header) || got.Filter.String() != tt.filter {
+				t.Errorf("parseBlock() = %+v filter %q, want %+v filter %q", got, got.Filter, tt.want, tt.filter)
+			}
+		})
+	}
+}
+
+func TestParseBlockError(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		",reset",
+		"example.com,close,reset",
+		"example.com,reset,body=gone",
+		"example.com,status=gone",
+		"example.com,header=X-A",
+		"example.com,drop",
+		"example.com,filter=stauts:404",
+	} {
+		if _, err := parseBlock(spec); err == nil {
+			t.Errorf("parseBlock(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/proxy"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// dump detail level
+	dumpDetail int
+
+	// auto, always or never
+	dumpColor string
+
+	// capture files printed instead of running the proxy
+	dumpReadFiles []string
+
+	// jsonl capture file the printed flows are written to
+	dumpWriteFile string
+)
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump [filter expression]",
+	Short: "run the proxy and print the flows to the terminal",
+	Long: `dump runs the proxy like the root command and prints one line per completed or failed flow,
+with headers and bodies at higher --detail levels.
+
+only the flows matching the filter expression are printed and written, e.g.
+  mitmfoxy dump 'host:*.example.com and (status>=400 or duration>2s)'
+
+` + filterUsage,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		expr, err := filter.Parse(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		if dumpDetail < capture.DumpLine || dumpDetail > capture.DumpFullBodies {
+			return fmt.Errorf("invalid detail %d, want %d to %d", dumpDetail, capture.DumpLine, capture.DumpFullBodies)
+		}
+		color, err := dumpColorEnabled(dumpColor)
+		if err != nil {
+			return err
+		}
+
+		dump := capture.NewDumpSink(os.Stdout, &capture.DumpConfig{
+			Detail: dumpDetail,
+			Color:  color,
+			Filter: expr,
+		}, logrus.StandardLogger())
+
+		var write capture.Sink
+		if len(dumpWriteFile) > 0 {
+			f, err := os.Create(dumpWriteFile)
+			if err != nil {
+				dump.Close()
+				return err
+			}
+			write = &capture.FilteredSink{
+				Sink:   capture.NewJSONLSink(f, nil, logrus.StandardLogger()),
+				Filter: expr,
+			}
+		}
+
+		if len(dumpReadFiles) > 0 {
+			cmd.SilenceUsage = true
+			return dumpFiles(dump, write)
+		}
+
+		opts := []proxy.Option{proxy.WithSinks(dump)}
+		if write != nil {
+			opts = append(opts, proxy.WithSinks(write))
+		}
+		return runProxy(cmd, opts...)
+	},
+}
+
+// dumpFiles prints the flows of the read files and writes them to write, if not nil
+func dumpFiles(dump *capture.DumpSink, write capture.Sink) (err error) {
+	sinks := capture.Sinks{dump}
+	if write != nil {
+		sinks = append(sinks, write)
+	}
+	defer func() {
+		if closeErr := sinks.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for _, name := range dumpReadFiles {
+		flows, err := capture.ReadFlowsFile(name)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		for _, flow := range flows {
+			if err := dump.Print(flow); err != nil {
+				return err
+			}
+			if write != nil {
+				write.Publish(capture.StoredFlowEvent(flow))
+			}
+		}
+	}
+
+	return nil
+}
+
+// dumpColorEnabled resolves the color mode, auto colors terminals unless NO_COLOR is set
+func dumpColorEnabled(mode string) (bool, error) {
+	switch strings.ToLower(mode) {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if len(os.Getenv("NO_COLOR")) > 0 {
+			return false, nil
+		}
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("invalid color %q, want auto, always or never", mode)
+	}
+}
+
+func init() {
+	addProxyFlags(dumpCmd.Flags())
+	dumpCmd.Flags().IntVarP(&dumpDetail, "detail", "d", capture.DumpLine, "1 prints a line per flow, 2 adds headers, 3 adds bodies truncated to 1KB, 4 adds full bodies")
+	dumpCmd.Flags().StringVar(&dumpColor, "color", "auto", "colorize the output: auto, always or never")
+	dumpCmd.Flags().StringArrayVarP(&dumpReadFiles, "read", "r", nil, "print the flows of this har or jsonl capture file instead of running the proxy, repeatable")
+	dumpCmd.Flags().StringVar(&dumpWriteFile, "write", "", "also write the printed flows to this jsonl capture file")
+
+	rootCmd.AddCommand(dumpCmd)
+}
@@ -0,0 +1,18 @@
+package cmd
+
+// filterUsage describes the filter expressions of the dump and replay commands
+const filterUsage = `filter expressions combine terms with and, or, not and parentheses, adjacent terms are and-ed:
+  host:GLOB            request host, e.g. host:*.example.com
+  path:REGEX           request path, e.g. path:^/api/
+  url:REGEX            full request url
+  method:NAME          request method
+  status:CODE          404, 4xx or 400-499, also status>=400
+  header:NAME[=REGEX]  request or response header, reqheader and respheader for one side
+  body:TEXT            decoded request or response body contains TEXT, reqbody and respbody for one side
+  type:TEXT            content type contains TEXT
+  size>SIZE            response body size, e.g. size>=1MB
+  duration>DURATION    e.g. duration>500ms
+  conn:ID              client or server conn id
+  error, replay        failed or replayed flows
+  all                  every flow
+values with spaces or parentheses are quoted, e.g. body:"not found"`
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/proxy/maplocal"
+)
+
+// map local spec syntax, a url pattern and its local path followed by comma separated options
+const mapLocalUsage = `answer the requests matching a url pattern from a local file or directory without contacting upstream, repeatable
+  PATTERN=PATH[,status=CODE][,header=NAME:VALUE]...
+the pattern is [scheme://]host[:port][/path], the host a glob and the path a prefix,
+directories are looked up by the path below the prefix, e.g. cdn.example.com/static/=./dist`
+
+// parseMapLocal parses a map local rule spec
+func parseMapLocal(spec string) (maplocal.Rule, error) {
+	fields := strings.Split(spec, ",")
+	pattern, path, ok := strings.Cut(fields[0], "=")
+	if !ok || len(pattern) == 0 || len(path) == 0 {
+		return maplocal.Rule{}, fmt.Errorf("invalid map local %q, want PATTERN=PATH", spec)
+	}
+
+	rule := maplocal.Rule{URL: pattern, Path: path}
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "status":
+			code, err := strconv.Atoi(value)
+			if err != nil {
+				return maplocal.Rule{}, fmt.Errorf("map local %s: invalid status %q", pattern, value)
+			}
+			rule.Status = code
+		case "header":
+			k, v, ok := strings.Cut(value, ":")
+			if !ok {
+				return maplocal.Rule{}, fmt.Errorf("map local %s: invalid header %q, want NAME:VALUE", pattern, value)
+			}
+			if rule.Header == nil {
+				rule.Header = make(http.Header)
+			}
+			rule.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+		default:
+			return maplocal.Rule{}, fmt.Errorf("map local %s: unknown option %q", pattern, name)
+		}
+	}
+
+	return rule, nil
+}
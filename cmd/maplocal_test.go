@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/proxy/maplocal"
+)
+
+func TestParseMapLocal(t *testing.T) {
+	tests := []struct {
+		spec string
+		want maplocal.Rule
+	}{
+		{"example.com/=./dist", maplocal.Rule{URL: "example.com/", Path: "./dist"}},
+		{"https://example.com/a=b=c", maplocal.Rule{URL: "https://example.com/a", Path: "b=c"}},
+		{
+			"example.com/api=./api.json,status=201,header=Content-Type: application/json,header=X-A:1",
+			maplocal.Rule{
+				URL:    "example.com/api",
+				Path:   "./api.json",
+				Status: 201,
+				Header: http.Header{"Content-Type": {"application/json"}, "X-A": {"1"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseMapLocal(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMapLocal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMapLocalError(t *testing.T) {
+	for _, spec := range []string{
+		"example.com",
+		"=./dist",
+		"example.com=",
+		"example.com=./dist,status=ok",
+		"example.com=./dist,header=X-A",
+		"example.com=./dist,mode=0644",
+	} {
+		if _, err := parseMapLocal(spec); err == nil {
+			t.Errorf("parseMapLocal(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/proxy/mapremote"
+)
+
+// map remote spec syntax, a url pattern and its target followed by comma separated options
+const mapRemoteUsage = `send the requests matching a url pattern to another scheme, host, port or path, repeatable
+  PATTERN=TARGET[,preserve-host]
+the pattern is like in --map-local, the target path replaces the matched prefix,
+e.g. https://api.example.com=http://localhost:3000 serves intercepted https requests from a local http server`
+
+// parseMapRemote parses a map remote rule spec
+func parseMapRemote(spec string) (mapremote.Rule, error) {
+	fields := strings.Split(spec, ",")
+	pattern, target, ok := strings.Cut(fields[0], "=")
+	if !ok || len(pattern) == 0 || len(target) == 0 {
+		return mapremote.Rule{}, fmt.Errorf("invalid map remote %q, want PATTERN=TARGET", spec)
+	}
+
+	rule := mapremote.Rule{URL: pattern, Target: target}
+	for _, field := range fields[1:] {
+		switch field {
+		case "preserve-host":
+			rule.PreserveHost = true
+		default:
+			return mapremote.Rule{}, fmt.Errorf("map remote %s: unknown option %q", pattern, field)
+		}
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/proxy/mapremote"
+)
+
+func TestParseMapRemote(t *testing.T) {
+	tests := []struct {
+		spec string
+		want mapremote.Rule
+	}{
+		{"https://api.example.com=http://localhost:3000", mapremote.Rule{URL: "https://api.example.com", Target: "http://localhost:3000"}},
+		{"example.com/v1=https://staging.example.com/v2,preserve-host", mapremote.Rule{URL: "example.com/v1", Target: "https://staging.example.com/v2", PreserveHost: true}},
+		{"example.com=http://localhost:3000/?a=b", mapremote.Rule{URL: "example.com", Target: "http://localhost:3000/?a=b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseMapRemote(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseMapRemote() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMapRemoteError(t *testing.T) {
+	for _, spec := range []string{"example.com", "=http://localhost", "example.com=", "example.com=http://localhost,keep-host"} {
+		if _, err := parseMapRemote(spec); err == nil {
+			t.Errorf("parseMapRemote(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/Twacqwq/mitmfoxy/proxy/replay"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// addr of the running proxy control endpoints
+	replayAddr string
+
+	// token of the running proxy
+	replayToken string
+
+	// filter expression selecting the replayed flows instead of ids
+	replayFilter string
+
+	// edits applied before sending
+	replayEdit replay.Edit
+
+	// raw -H values
+	replayHeaders []string
+
+	// replaces the body with the file content
+	replayBodyFile string
+	replayBody     string
+
+	// print the replayed flows as json
+	replayJSON bool
+
+	// capture files replayed in-process instead of the flows stored by a running proxy
+	replayFiles []string
+
+	// load settings of file replays
+	replayLoad replay.LoadConfig
+
+	// sink specs the flows of file replays are recorded to
+	replaySinkSpecs []string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [flow id...]",
+	Short: "replay captured requests",
+	Long: `replay re-sends captured requests through a running proxy to their original upstream,
+or to --target, and records each response as a new flow linked to the original by replay_of.
+flows are selected by id or by a --filter expression.
+
+with --file the flows of capture files are replayed from here instead, --count times with
+--concurrency requests in flight at most, then a latency and status summary is printed.
+
+` + filterUsage,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		edit, err := replayEditFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		expr, err := filter.Parse(replayFilter)
+		if err != nil {
+			return err
+		}
+		if len(replayFiles) > 0 {
+			replayLoad.Edit = edit
+			if err := replayLoad.Validate(); err != nil {
+				return err
+			}
+			cmd.SilenceUsage = true
+			return replayFilesRun(cmd, args, expr)
+		}
+
+		req := &replay.Request{IDs: args, Edit: edit}
+		if len(args) == 0 {
+			if expr.Empty() {
+				return errors.New("select the flows to replay by id or --filter")
+			}
+			req.Expr = expr
+		}
+		cmd.SilenceUsage = true
+
+		var resp replay.Response
+		if err := postControl(replayAddr, replayToken, "/replay", req, &resp); err != nil {
+			return err
+		}
+
+		if replayJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(resp.Flows)
+		}
+
+		var failed int
+		for _, flow := range resp.Flows {
+			if len(flow.Error) > 0 {
+				failed++
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), replayLine(flow))
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d replays failed", failed, len(resp.Flows))
+		}
+
+		return nil
+	},
+}
+
+// replayEditFromFlags builds the edit of the replayed requests
+func replayEditFromFlags(cmd *cobra.Command) (*replay.Edit, error) {
+	edit := replayEdit
+	for _, h := range replayHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || len(strings.TrimSpace(name)) == 0 {
+			return nil, fmt.Errorf("invalid header %q, want \"Name: value\"", h)
+		}
+		if edit.Header == nil {
+			edit.Header = make(http.Header)
+		}
+		edit.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if cmd.Flags().Changed("body") {
+		edit.Body = &replayBody
+	}
+	if len(replayBodyFile) > 0 {
+		body, err := os.ReadFile(replayBodyFile)
+		if err != nil {
+			return nil, err
+		}
+		s := string(body)
+		edit.Body = &s
+	}
+	if err := edit.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &edit, nil
+}
+
+// replayFilesRun replays the flows of the capture files selected by ids and expr
+// and prints the summary, failed requests make it exit non-zero
+func replayFilesRun(cmd *cobra.Command, ids []string, expr *filter.Expr) error {
+	var flows []*model.PacketCaptureFlow
+	for _, name := range replayFiles {
+		loaded, err := capture.ReadFlowsFile(name)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		flows = append(flows, loaded...)
+	}
+
+	if len(ids) > 0 {
+		flows = slices.DeleteFunc(flows, func(flow *model.PacketCaptureFlow) bool {
+			return !slices.Contains(ids, flow.ID)
+		})
+	}
+	flows = slices.DeleteFunc(flows, func(flow *model.PacketCaptureFlow) bool {
+		return !expr.Match(flow)
+	})
+
+	var sinks capture.Sinks
+	for _, spec := range replaySinkSpecs {
+		sink, err := parseSink(spec, logrus.StandardLogger())
+		if err != nil {
+			sinks.Close()
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	defer sinks.Close()
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	replayer := replay.New(nil, sinks, nil, logrus.StandardLogger())
+	defer replayer.Close()
+
+	summary, err := replayer.Load(ctx, flows, &replayLoad)
+	if err != nil {
+		return err
+	}
+
+	if replayJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			return err
+		}
+	} else {
+		printSummary(cmd.OutOrStdout(), summary)
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", summary.Failed, summary.Requests)
+	}
+
+	return nil
+}
+
+// printSummary prints a load replay summary for humans
+func printSummary(w io.Writer, s *replay.Summary) {
+	var rate float64
+	if s.Duration > 0 {
+		rate = float64(s.Requests) / s.Duration.Seconds()
+	}
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Microsecond * 10)
+	}
+
+	fmt.Fprintf(w, "requests  %d in %s, %.1f/s, %d failed\n", s.Requests, round(s.Duration), rate, s.Failed)
+	fmt.Fprintf(w, "latency   min %s  mean %s  p50 %s  p90 %s  p99 %s  max %s\n",
+		round(s.Latency.Min), round(s.Latency.Mean), round(s.Latency.P50), round(s.Latency.P90), round(s.Latency.P99), round(s.Latency.Max))
+	for _, code := range slices.Sorted(maps.Keys(s.Status)) {
+		fmt.Fprintf(w, "status    %d  %d\n", code, s.Status[code])
+	}
+	for _, msg := range slices.Sorted(maps.Keys(s.Errors)) {
+		fmt.Fprintf(w, "error     %d  %s\n", s.Errors[msg], msg)
+	}
+}
+
+// replayLine summarizes a replayed flow
+func replayLine(flow *model.PacketCaptureFlow) string {
+	status := "error: " + flow.Error
+	if flow.Response != nil && len(flow.Error) == 0 {
+		status = fmt.Sprintf("%d %s", flow.Response.StatusCode, flow.Response.StatusText)
+	}
+
+	var duration string
+	if t := flow.Timing; t != nil && !t.ResponseComplete.IsZero() {
+		duration = " " + t.ResponseComplete.Sub(t.RequestStart).Round(time.Millisecond/10).String()
+	}
+
+	return fmt.Sprintf("%s %s -> %s%s flow %s replay of %s", flow.Request.Method, flow.Request.Url, status, duration, flow.ID, flow.ReplayOf)
+}
+
+// postControl posts body as json to a control endpoint of a running proxy and decodes the json response into v
+func postControl(addr, token, path string, body, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayAddr, "addr", "127.0.0.1:8989", "control addr of the running proxy, its --control-addr or proxy port")
+	replayCmd.Flags().StringVar(&replayToken, "token", os.Getenv("MITMFOXY_TOKEN"), "capture token of the running proxy, defaults to $MITMFOXY_TOKEN")
+	replayCmd.Flags().StringVarP(&replayFilter, "filter", "f", "", "replay the flows matching this filter expression, e.g. 'host:api.example.com method:POST'")
+	replayCmd.Flags().StringVar(&replayEdit.Method, "method", "", "send with this method")
+	replayCmd.Flags().StringVar(&replayEdit.URL, "url", "", "send to this url instead")
+	replayCmd.Flags().StringVar(&replayEdit.Target, "target", "", "send to this scheme and host, keeping the path, e.g. http://localhost:8080")
+	replayCmd.Flags().StringArrayVarP(&replayHeaders, "header", "H", nil, "set a header, \"Name: value\", repeatable")
+	replayCmd.Flags().StringArrayVar(&replayEdit.DelHeader, "del-header", nil, "remove a header, repeatable")
+	replayCmd.Flags().StringVar(&replayBody, "body", "", "send this body")
+	replayCmd.Flags().StringVar(&replayBodyFile, "body-file", "", "send the content of this file as body")
+	replayCmd.Flags().BoolVar(&replayJSON, "json", false, "print the replayed flows, or the summary with --file, as json")
+	replayCmd.Flags().StringArrayVar(&replayFiles, "file", nil, "replay the flows of this har or jsonl capture file from here instead of a running proxy, repeatable")
+	replayCmd.Flags().IntVarP(&replayLoad.Count, "count", "n", 1, "with --file, replay the flows this many times")
+	replayCmd.Flags().IntVar(&replayLoad.Concurrency, "concurrency", 1, "with --file, requests in flight at most, or passes in flight for the recorded order")
+	replayCmd.Flags().Float64Var(&replayLoad.Rate, "rate", 0, "with --file, requests started per second at most, 0 is unlimited")
+	replayCmd.Flags().StringVar(&replayLoad.Order, "order", replay.OrderFast, "with --file, fast sends as workers free up, recorded sends each pass in order, timed keeps the recorded inter-arrival times")
+	replayCmd.Flags().StringArrayVar(&replaySinkSpecs, "sink", nil, "with --file, record the replayed flows to this sink, see the proxy --sink flag, repeatable")
+	replayCmd.MarkFlagsMutuallyExclusive("body", "body-file")
+	replayCmd.MarkFlagsMutuallyExclusive("url", "target")
+
+	rootCmd.AddCommand(replayCmd)
+}
@@ -0,0 +1,11 @@
+package cmd
+
+// rewriteUsage describes the rewrite config files
+const rewriteUsage = `rewrite the matching requests and responses by the rules of this json file, repeatable, e.g.
+  {"rules": [
+    {"phase": "request", "filter": "host:api.example.com", "set_header": {"X-Feature": "beta"}, "set_query": {"debug": "1"}},
+    {"phase": "response", "filter": "path:^/config type:json", "remove_header": ["Cache-Control"],
+     "replace_body": [{"pattern": "\"beta\":\\s*false", "replacement": "\"beta\":true"}]}
+  ]}
+rules take a filter expression, remove_header, set_header, append_header, set_query and remove_query in the request phase,
+and replace_body regexp replacements in the decoded body`
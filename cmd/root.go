@@ -2,10 +2,28 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/har"
+	"github.com/Twacqwq/mitmfoxy/model"
 	"github.com/Twacqwq/mitmfoxy/proxy"
+	"github.com/Twacqwq/mitmfoxy/proxy/block"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/Twacqwq/mitmfoxy/proxy/intercept"
+	"github.com/Twacqwq/mitmfoxy/proxy/maplocal"
+	"github.com/Twacqwq/mitmfoxy/proxy/mapremote"
+	"github.com/Twacqwq/mitmfoxy/proxy/playback"
+	"github.com/Twacqwq/mitmfoxy/proxy/rewrite"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -20,23 +38,256 @@ var (
 
 	// use websocket to recv packet capture
 	useWebsocket bool
+
+	// time allowed to drain in-flight flows on shutdown
+	shutdownTimeout time.Duration
+
+	// number of recent flows kept for capture clients
+	historySize int
+
+	// loopback addr serving the capture endpoints, empty shares the proxy port
+	controlAddr string
+
+	// token capture clients must present
+	captureToken string
+
+	// origins browsers may open capture clients from
+	allowedOrigins []string
+
+	// sink specs capture events are recorded to
+	sinkSpecs []string
+
+	// har file the stored flows are written to on shutdown
+	harFile string
+
+	// also write the har file this often
+	harInterval time.Duration
+
+	// har and jsonl capture files loaded into the store at startup
+	loadFiles []string
+
+	// har and jsonl capture files requests are answered from instead of upstream
+	playbackFiles []string
+
+	// playback matching rules
+	playbackConf playback.Config
+
+	// block rule specs
+	blockSpecs []string
+
+	// map local rule specs
+	mapLocalSpecs []string
+
+	// map remote rule specs
+	mapRemoteSpecs []string
+
+	// json rewrite rule files
+	rewriteFiles []string
+
+	// breakpoint rules, filter expressions
+	interceptRequest, interceptResponse string
+
+	// breakpoint timeout policy
+	interceptConf intercept.Config
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "mitmproxy",
 	Short: "a mitm proxy tools",
-	Run: func(cmd *cobra.Command, args []string) {
-		mitmproxy := proxy.New(&proxy.Config{
-			Addr:         fmt.Sprintf(":%d", port),
-			CertFile:     certFile,
-			KeyFile:      keyFile,
-			UseWebsocket: useWebsocket,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProxy(cmd)
+	},
+}
+
+// runProxy runs the proxy configured by the proxy flags until interrupted
+// opts are applied after the options built from the flags
+func runProxy(cmd *cobra.Command, extra ...proxy.Option) error {
+	// flags are valid by now, errors from here on are not usage errors
+	cmd.SilenceUsage = true
+
+	var err error
+	if interceptConf.Request, err = filter.Parse(interceptRequest); err != nil {
+		return fmt.Errorf("intercept request: %w", err)
+	}
+	if interceptConf.Response, err = filter.Parse(interceptResponse); err != nil {
+		return fmt.Errorf("intercept response: %w", err)
+	}
+	if err := interceptConf.Validate(); err != nil {
+		return err
+	}
+
+	opts := []proxy.Option{proxy.WithStore(capture.NewStore(historySize))}
+	for _, spec := range sinkSpecs {
+		sink, err := parseSink(spec, logrus.StandardLogger())
+		if err != nil {
+			return err
+		}
+		opts = append(opts, proxy.WithSinks(sink))
+	}
+
+	if len(blockSpecs) > 0 {
+		rules := make([]block.Rule, 0, len(blockSpecs))
+		for _, spec := range blockSpecs {
+			rule, err := parseBlock(spec)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		blocker, err := block.New(rules, logrus.StandardLogger())
+		if err != nil {
+			return err
+		}
+		opts = append(opts, proxy.WithAddons(blocker))
+	}
+
+	if len(mapLocalSpecs) > 0 {
+		rules := make([]maplocal.Rule, 0, len(mapLocalSpecs))
+		for _, spec := range mapLocalSpecs {
+			rule, err := parseMapLocal(spec)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		mapLocal, err := maplocal.New(rules, logrus.StandardLogger())
+		if err != nil {
+			return err
+		}
+		opts = append(opts, proxy.WithAddons(mapLocal))
+	}
+
+	if len(mapRemoteSpecs) > 0 {
+		rules := make([]mapremote.Rule, 0, len(mapRemoteSpecs))
+		for _, spec := range mapRemoteSpecs {
+			rule, err := parseMapRemote(spec)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		mapRemote, err := mapremote.New(rules, logrus.StandardLogger())
+		if err != nil {
+			return err
+		}
+		opts = append(opts, proxy.WithAddons(mapRemote))
+	}
+
+	if len(rewriteFiles) > 0 {
+		var rules []rewrite.Rule
+		for _, name := range rewriteFiles {
+			fileRules, err := rewrite.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, fileRules...)
+		}
+		rewriter, err := rewrite.New(rules, logrus.StandardLogger())
+		if err != nil {
+			return fmt.Errorf("rewrite: %w", err)
+		}
+		opts = append(opts, proxy.WithAddons(rewriter))
+		logrus.Infof("loaded %d rewrite rules", len(rules))
+	}
+
+	var player *playback.Playback
+	if len(playbackFiles) > 0 {
+		var recorded []*model.PacketCaptureFlow
+		for _, name := range playbackFiles {
+			flows, err := capture.ReadFlowsFile(name)
+			if err != nil {
+				return err
+			}
+			recorded = append(recorded, flows...)
+		}
+
+		if player, err = playback.New(recorded, &playbackConf, logrus.StandardLogger()); err != nil {
+			return err
+		}
+		opts = append(opts, proxy.WithAddons(player))
+		logrus.Infof("playing back %d recorded flows", len(recorded))
+	}
+	opts = append(opts, extra...)
+
+	mitmproxy := proxy.New(&proxy.Config{
+		Addr:           fmt.Sprintf(":%d", port),
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		UseWebsocket:   useWebsocket,
+		ControlAddr:    controlAddr,
+		CaptureToken:   captureToken,
+		AllowedOrigins: allowedOrigins,
+		Offline:        player != nil && player.Offline(),
+		Intercept:      interceptConf,
+	}, opts...)
+
+	for _, name := range loadFiles {
+		flows, err := capture.ReadFlowsFile(name)
+		if err != nil {
+			return err
+		}
+		mitmproxy.Load(flows)
+		logrus.Infof("loaded %d flows from %s", len(flows), name)
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	chErr := make(chan error, 1)
+	go func() {
+		chErr <- mitmproxy.Start()
+	}()
+
+	var wg sync.WaitGroup
+	if len(harFile) > 0 && harInterval > 0 {
+		wg.Go(func() {
+			ticker := time.NewTicker(harInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := har.WriteFile(harFile, mitmproxy.Store().Flows()); err != nil {
+						logrus.Errorf("write har: %v", err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
 		})
+	}
+
+	select {
+	case err := <-chErr:
+		return err
+	case <-ctx.Done():
+	}
 
-		if err := mitmproxy.Start(); err != nil {
-			panic(err)
+	logrus.Info("shutting down")
+	stopCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = mitmproxy.Stop(stopCtx)
+
+	// the drained flows are stored by now
+	if len(harFile) > 0 {
+		wg.Wait()
+		flows := mitmproxy.Store().Flows()
+		if harErr := har.WriteFile(harFile, flows); harErr != nil {
+			err = errors.Join(err, fmt.Errorf("write har: %w", harErr))
+		} else {
+			logrus.Infof("wrote %d flows to %s", len(flows), harFile)
 		}
-	},
+	}
+	if player != nil {
+		logrus.Infof("playback answered %d requests, %d unmatched", player.Matched(), player.Unmatched())
+		if playbackConf.Unmatched == playback.UnmatchedFail && player.Unmatched() > 0 {
+			err = errors.Join(err, fmt.Errorf("playback: %d requests matched no recorded flow", player.Unmatched()))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return <-chErr
 }
 
 func Execute(ctx context.Context) error {
@@ -44,8 +295,35 @@ func Execute(ctx context.Context) error {
 }
 
 func init() {
-	rootCmd.Flags().IntVarP(&port, "port", "p", 8989, "network server port")
-	rootCmd.Flags().StringVarP(&certFile, "cert", "c", "", "root ca cert file")
-	rootCmd.Flags().StringVarP(&keyFile, "key", "k", "", "root ca key file")
-	rootCmd.Flags().BoolVarP(&useWebsocket, "ws", "w", false, "use websocket to recv packet capture")
+	addProxyFlags(rootCmd.Flags())
+}
+
+// addProxyFlags registers the flags configuring runProxy
+func addProxyFlags(flags *pflag.FlagSet) {
+	flags.IntVarP(&port, "port", "p", 8989, "network server port")
+	flags.StringVarP(&certFile, "cert", "c", "", "root ca cert file")
+	flags.StringVarP(&keyFile, "key", "k", "", "root ca key file")
+	flags.BoolVarP(&useWebsocket, "ws", "w", false, "use websocket to recv packet capture")
+	flags.IntVar(&historySize, "history", capture.DefaultStoreSize, "number of recent flows kept for capture clients")
+	flags.StringVar(&controlAddr, "control-addr", "", "serve the capture endpoints on this loopback addr instead of the proxy port, e.g. 127.0.0.1:8990")
+	flags.StringVar(&captureToken, "token", "", "token capture clients must present, generated at startup when empty")
+	flags.StringSliceVar(&allowedOrigins, "allow-origin", nil, "origin browsers may open capture clients from, repeatable")
+	flags.StringArrayVar(&sinkSpecs, "sink", nil, sinkUsage)
+	flags.StringVar(&harFile, "har", "", "write the stored flows to this har file on shutdown")
+	flags.DurationVar(&harInterval, "har-interval", 0, "also write the har file this often, e.g. 30s")
+	flags.StringArrayVar(&loadFiles, "load", nil, "load the flows of a har or jsonl capture file into the store, repeatable")
+	flags.StringArrayVar(&playbackFiles, "playback", nil, "answer requests from the flows of a har or jsonl capture file instead of upstream, repeatable")
+	flags.StringVar(&playbackConf.Unmatched, "playback-unmatched", playback.UnmatchedNotFound, "policy for requests matching no recorded flow: 404, passthrough or fail, fail exits non-zero")
+	flags.StringSliceVar(&playbackConf.Headers, "playback-header", nil, "request header that must match in playback, repeatable")
+	flags.BoolVar(&playbackConf.Body, "playback-body", false, "request bodies must match in playback")
+	flags.StringSliceVar(&playbackConf.IgnoreQuery, "playback-ignore-query", nil, "query parameter ignored when matching in playback, repeatable")
+	flags.StringArrayVar(&blockSpecs, "block", nil, blockUsage)
+	flags.StringArrayVar(&mapLocalSpecs, "map-local", nil, mapLocalUsage)
+	flags.StringArrayVar(&mapRemoteSpecs, "map-remote", nil, mapRemoteUsage)
+	flags.StringArrayVar(&rewriteFiles, "rewrite", nil, rewriteUsage)
+	flags.StringVar(&interceptRequest, "intercept-request", "", "pause the requests matching this filter expression until resolved over the control api, e.g. 'method:POST host:api.example.com' or all")
+	flags.StringVar(&interceptResponse, "intercept-response", "", "pause the responses matching this filter expression until resolved over the control api")
+	flags.DurationVar(&interceptConf.Timeout, "intercept-timeout", intercept.DefaultTimeout, "how long a breakpoint waits to be resolved")
+	flags.StringVar(&interceptConf.OnTimeout, "intercept-timeout-action", model.ResolveResume, "how breakpoints nobody resolved in time are resolved: resume or drop")
+	flags.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "time allowed to drain in-flight flows on shutdown")
 }
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/internal/bytesize"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/sirupsen/logrus"
+)
+
+// sink spec syntax, a kind with its target followed by comma separated options
+const sinkUsage = `record capture events to a sink, repeatable
+  stdout[,events=TYPE+TYPE]
+  file=PATH[,max-size=64MB][,max-age=1h][,gzip][,events=TYPE+TYPE]
+  webhook=URL[,batch=100][,interval=1s][,retries=5][,backoff=500ms][,header=NAME:VALUE]...[,events=TYPE+TYPE]
+events default to response_complete+flow_error`
+
+// options of each sink kind besides events
+var sinkOptions = map[string][]string{
+	"stdout":  {},
+	"file":    {"max-size", "max-age", "gzip"},
+	"webhook": {"batch", "interval", "retries", "backoff", "header"},
+}
+
+// parseSink builds the sink described by spec
+func parseSink(spec string, logger logrus.FieldLogger) (capture.Sink, error) {
+	fields := strings.Split(spec, ",")
+	kind, target, _ := strings.Cut(fields[0], "=")
+	known, ok := sinkOptions[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q", kind)
+	}
+
+	var events []string
+	opts := make(url.Values)
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch {
+		case name == "events":
+			events = strings.Split(value, "+")
+			if err := capture.ValidateEventTypes(events); err != nil {
+				return nil, fmt.Errorf("sink %s: %w", kind, err)
+			}
+		case slices.Contains(known, name):
+			opts.Add(name, value)
+		default:
+			return nil, fmt.Errorf("sink %s: unknown option %q", kind, name)
+		}
+	}
+
+	var (
+		sink capture.Sink
+		err  error
+	)
+	switch kind {
+	case "stdout":
+		// the sink must not close stdout
+		sink = capture.NewJSONLSink(struct{ io.Writer }{os.Stdout}, events, logger)
+	case "file":
+		sink, err = parseFileSink(target, opts, events, logger)
+	case "webhook":
+		sink, err = parseWebhookSink(target, opts, events, logger)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", kind, err)
+	}
+
+	return sink, nil
+}
+
+// parseFileSink builds a rotating jsonl file sink
+func parseFileSink(path string, opts url.Values, events []string, logger logrus.FieldLogger) (capture.Sink, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("missing path, e.g. file=captures/flows.jsonl")
+	}
+
+	var (
+		maxSize int64
+		maxAge  time.Duration
+		err     error
+	)
+	if v := opts.Get("max-size"); len(v) > 0 {
+		if maxSize, err = bytesize.Parse(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := opts.Get("max-age"); len(v) > 0 {
+		if maxAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid max-age %q", v)
+		}
+	}
+	compress := opts.Has("gzip")
+
+	f, err := capture.NewRotatingFile(path, maxSize, maxAge, compress)
+	if err != nil {
+		return nil, err
+	}
+
+	return capture.NewJSONLSink(f, events, logger), nil
+}
+
+// parseWebhookSink builds a webhook sink
+func parseWebhookSink(target string, opts url.Values, events []string, logger logrus.FieldLogger) (capture.Sink, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid url %q", target)
+	}
+
+	conf := &capture.WebhookConfig{
+		URL:    target,
+		Header: make(http.Header),
+		Events: events,
+	}
+	for name, values := range opts {
+		value := values[len(values)-1]
+		switch name {
+		case "batch":
+			conf.BatchSize, err = strconv.Atoi(value)
+		case "interval":
+			conf.FlushInterval, err = time.ParseDuration(value)
+		case "retries":
+			conf.Retries, err = strconv.Atoi(value)
+			if err == nil && conf.Retries == 0 {
+				conf.Retries = -1
+			}
+		case "backoff":
+			conf.Backoff, err = time.ParseDuration(value)
+		case "header":
+			for _, value := range values {
+				k, v, ok := strings.Cut(value, ":")
+				if !ok {
+					return nil, fmt.Errorf("invalid header %q, want NAME:VALUE", value)
+				}
+				conf.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+	}
+
+	return capture.NewWebhookSink(conf, logger), nil
+}
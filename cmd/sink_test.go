@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func testEvents() []*model.Event {
+	return []*model.Event{
+		model.NewFlowEvent(model.EventResponseComplete, &model.PacketCaptureFlow{ID: "complete"}),
+		model.NewFlowEvent(model.EventFlowError, &model.PacketCaptureFlow{ID: "error", Error: "refused"}),
+	}
+}
+
+func TestParseSinkFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	sink, err := parseSink("file="+path+",max-size=1MB,max-age=1h,events=flow_error", testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents() {
+		sink.Publish(event)
+	}
+	if err := (capture.Sinks{sink}).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"id":"error"`) {
+		t.Errorf("file = %q, want the flow_error event only", data)
+	}
+}
+
+func TestParseSinkWebhook(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers []http.Header
+		batches [][]*model.Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*model.Event
+		json.NewDecoder(r.Body).Decode(&batch)
+		mu.Lock()
+		headers, batches = append(headers, r.Header), append(batches, batch)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	spec := "webhook=" + srv.URL + "/hook?a=b,batch=1,interval=1h,retries=0,header=Authorization: Bearer token,header=X-A:1,header=X-A:2"
+	sink, err := parseSink(spec, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents() {
+		sink.Publish(event)
+	}
+	if err := (capture.Sinks{sink}).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || len(batches[0]) != 1 || len(batches[1]) != 1 {
+		t.Fatalf("posted %d batches, want 2 batches of 1", len(batches))
+	}
+	if got := headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want Bearer token", got)
+	}
+	if got := headers[0].Values("X-A"); strings.Join(got, ",") != "1,2" {
+		t.Errorf("X-A = %q, want [1 2]", got)
+	}
+}
+
+func TestParseSinkError(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"syslog",
+		"stdout,gzip",
+		"stdout,events=flow",
+		"file",
+		"file=x.jsonl,max-size=lots",
+		"file=x.jsonl,max-age=soon",
+		"webhook=ftp://example.com",
+		"webhook=http://example.com,batch=many",
+		"webhook=http://example.com,backoff=1",
+		"webhook=http://example.com,header=X-A",
+	} {
+		if _, err := parseSink(spec, testLogger()); err == nil {
+			t.Errorf("parseSink(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -5,8 +5,8 @@ import "github.com/Twacqwq/mitmfoxy/proxy"
 func main() {
 	conf := &proxy.Config{
 		Addr:         ":8443",
-		CertFile:     "../../internal/cert/ca.crt",
-		KeyFile:      "../../internal/cert/ca.key",
+		CertFile:     "../../cert/ca.crt",
+		KeyFile:      "../../cert/ca.key",
 		UseWebsocket: false,
 	}
 
@@ -0,0 +1,359 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/internal/bytesize"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// operators of the fields
+const (
+	opsEqual   = " : "
+	opsCompare = " : > >= < <= "
+)
+
+// field is a term field of the language
+type field struct {
+	name string
+
+	// shown in errors
+	usage string
+
+	// supported operators, space separated and padded
+	ops string
+
+	// the field is a flag, e.g. error
+	noValue bool
+
+	// the field reads the bodies, which are unknown before they are buffered
+	body bool
+
+	// the field matches conn ids, the only field known for connection events
+	conn bool
+
+	// builds the term of op and value
+	build func(op, value string) (term, error)
+}
+
+var fields = map[string]*field{}
+
+func init() {
+	for _, f := range []*field{
+		{name: "host", usage: "host:*.example.com", ops: opsEqual, build: hostTerm},
+		{name: "path", usage: "path:^/api/", ops: opsEqual, build: pathTerm},
+		{name: "url", usage: "url:example.com/api", ops: opsEqual, build: urlTerm},
+		{name: "method", usage: "method:POST", ops: opsEqual, build: methodTerm},
+		{name: "status", usage: "status:4xx or status>=400", ops: opsCompare, build: statusTerm},
+		{name: "header", usage: "header:Authorization or header:Content-Type=json", ops: opsEqual, build: headerTerm(true, true)},
+		{name: "reqheader", usage: "reqheader:Cookie=session", ops: opsEqual, build: headerTerm(true, false)},
+		{name: "respheader", usage: "respheader:Set-Cookie", ops: opsEqual, build: headerTerm(false, true)},
+		{name: "body", usage: "body:token", ops: opsEqual, build: bodyTerm(true, true), body: true},
+		{name: "reqbody", usage: "reqbody:password", ops: opsEqual, build: bodyTerm(true, false), body: true},
+		{name: "respbody", usage: "respbody:error", ops: opsEqual, build: bodyTerm(false, true), body: true},
+		{name: "type", usage: "type:json", ops: opsEqual, build: typeTerm},
+		{name: "size", usage: "size>1MB", ops: opsCompare, build: sizeTerm, body: true},
+		{name: "duration", usage: "duration>500ms", ops: opsCompare, build: durationTerm},
+		{name: "conn", usage: "conn:CONN_ID", ops: opsEqual, build: connTerm, conn: true},
+		{name: "error", usage: "error", noValue: true, build: errorTerm},
+		{name: "replay", usage: "replay", noValue: true, build: replayTerm},
+		{name: "all", usage: "all", noValue: true, build: allTerm},
+	} {
+		fields[f.name] = f
+	}
+}
+
+func hostTerm(_, value string) (term, error) {
+	glob := strings.ToLower(value)
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q", value)
+	}
+
+	return func(v *view) bool {
+		u := v.url()
+		if u == nil {
+			return false
+		}
+		ok, _ := path.Match(glob, strings.ToLower(u.Hostname()))
+		return ok
+	}, nil
+}
+
+func pathTerm(_, value string) (term, error) {
+	re, err := compile(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v *view) bool {
+		u := v.url()
+		return u != nil && re.MatchString(u.Path)
+	}, nil
+}
+
+func urlTerm(_, value string) (term, error) {
+	re, err := compile(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v *view) bool {
+		return v.flow.Request != nil && re.MatchString(v.flow.Request.Url)
+	}, nil
+}
+
+func methodTerm(_, value string) (term, error) {
+	return func(v *view) bool {
+		return v.flow.Request != nil && strings.EqualFold(v.flow.Request.Method, value)
+	}, nil
+}
+
+// statusTerm matches a code, a class like 4xx or a range like 400-499, or compares the code
+func statusTerm(op, value string) (term, error) {
+	lo, hi, err := statusRange(op, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v *view) bool {
+		if v.flow.Response == nil {
+			return false
+		}
+		code := v.flow.Response.StatusCode
+		return code >= lo && code <= hi
+	}, nil
+}
+
+func statusRange(op, value string) (lo, hi int, err error) {
+	if op == ":" {
+		if class, ok := strings.CutSuffix(strings.ToLower(value), "xx"); ok {
+			n, err := strconv.Atoi(class)
+			if err != nil || n < 1 || n > 5 {
+				return 0, 0, fmt.Errorf("invalid status class %q, want 1xx to 5xx", value)
+			}
+			return n * 100, n*100 + 99, nil
+		}
+		if from, to, ok := strings.Cut(value, "-"); ok {
+			lo, err1 := strconv.Atoi(from)
+			hi, err2 := strconv.Atoi(to)
+			if err1 != nil || err2 != nil || lo > hi {
+				return 0, 0, fmt.Errorf("invalid status range %q, want e.g. 400-499", value)
+			}
+			return lo, hi, nil
+		}
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status %q, want e.g. 404, 4xx or 400-499", value)
+	}
+
+	switch op {
+	case ">":
+		return code + 1, 999, nil
+	case ">=":
+		return code, 999, nil
+	case "<":
+		return 0, code - 1, nil
+	case "<=":
+		return 0, code, nil
+	default:
+		return code, code, nil
+	}
+}
+
+// headerTerm matches a header name, or NAME=REGEX matching one of its values
+func headerTerm(request, response bool) func(op, value string) (term, error) {
+	return func(_, value string) (term, error) {
+		name, pattern, hasPattern := strings.Cut(value, "=")
+		if len(name) == 0 {
+			return nil, errors.New("missing header name")
+		}
+		name = http.CanonicalHeaderKey(name)
+
+		var re *regexp.Regexp
+		if hasPattern {
+			var err error
+			if re, err = compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		match := func(header http.Header) bool {
+			values, ok := header[name]
+			if !ok || re == nil {
+				return ok
+			}
+			return slices.ContainsFunc(values, re.MatchString)
+		}
+
+		return func(v *view) bool {
+			if request && v.flow.Request != nil && match(v.flow.Request.Header) {
+				return true
+			}
+			return response && v.flow.Response != nil && match(v.flow.Response.Header)
+		}, nil
+	}
+}
+
+func bodyTerm(request, response bool) func(op, value string) (term, error) {
+	return func(_, value string) (term, error) {
+		text := []byte(value)
+		return func(v *view) bool {
+			if request && bytes.Contains(v.requestBody(), text) {
+				return true
+			}
+			return response && bytes.Contains(v.responseBody(), text)
+		}, nil
+	}
+}
+
+func typeTerm(_, value string) (term, error) {
+	text := strings.ToLower(value)
+	contains := func(header http.Header) bool {
+		return strings.Contains(strings.ToLower(header.Get("Content-Type")), text)
+	}
+
+	return func(v *view) bool {
+		if v.flow.Request != nil && contains(v.flow.Request.Header) {
+			return true
+		}
+		return v.flow.Response != nil && contains(v.flow.Response.Header)
+	}, nil
+}
+
+func sizeTerm(op, value string) (term, error) {
+	size, err := bytesize.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v *view) bool {
+		return v.flow.Response != nil && compare(op, int64(len(v.flow.Response.Body)), size)
+	}, nil
+}
+
+func durationTerm(op, value string) (term, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration %q, want e.g. 500ms or 2s", value)
+	}
+
+	return func(v *view) bool {
+		t := v.flow.Timing
+		if t == nil || t.RequestStart.IsZero() || t.ResponseComplete.IsZero() {
+			return false
+		}
+		return compare(op, int64(t.ResponseComplete.Sub(t.RequestStart)), int64(d))
+	}, nil
+}
+
+func connTerm(_, value string) (term, error) {
+	is := func(conn *model.ConnInfo) bool {
+		return conn != nil && conn.ID == value
+	}
+
+	return func(v *view) bool {
+		return is(v.flow.ClientConn) || is(v.flow.ServerConn)
+	}, nil
+}
+
+func errorTerm(_, _ string) (term, error) {
+	return func(v *view) bool {
+		return len(v.flow.Error) > 0
+	}, nil
+}
+
+func replayTerm(_, _ string) (term, error) {
+	return func(v *view) bool {
+		return len(v.flow.ReplayOf) > 0
+	}, nil
+}
+
+func allTerm(_, _ string) (term, error) {
+	return func(*view) bool {
+		return true
+	}, nil
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		var syntaxErr *syntax.Error
+		if errors.As(err, &syntaxErr) {
+			return nil, fmt.Errorf("invalid regexp %q: %s", pattern, syntaxErr.Code)
+		}
+		return nil, fmt.Errorf("invalid regexp %q", pattern)
+	}
+
+	return re, nil
+}
+
+func compare(op string, a, b int64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	default:
+		return a == b
+	}
+}
+
+// unknownField describes an unknown field, suggesting the closest known one
+func unknownField(name string) string {
+	if best := closestField(name); len(best) > 0 {
+		return fmt.Sprintf("unknown field %q, did you mean %q?", name, best)
+	}
+
+	return fmt.Sprintf("unknown field %q, want one of %s", name, strings.Join(slices.Sorted(maps.Keys(fields)), ", "))
+}
+
+// closestField returns the field a misspelled name most likely meant, if any
+func closestField(name string) string {
+	best, bestDistance := "", 3
+	for field := range fields {
+		if d := distance(strings.ToLower(name), field); d < bestDistance {
+			best, bestDistance = field, d
+		}
+	}
+
+	return best
+}
+
+// distance is the levenshtein distance of a and b
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,199 @@
+// Package filter implements the flow filter expression language shared by the capture stream
+// subscriptions, replay, dump and the rewrite rules.
+//
+// An expression combines terms with and, or, not and parentheses, adjacent terms are and-ed:
+//
+//	host:*.example.com and (status:5xx or duration>2s)
+//	method:POST path:^/api/ !type:json
+//
+// Terms are a field, an operator and a value, values with spaces or parentheses are quoted:
+//
+//	host:GLOB          request host, e.g. host:*.example.com
+//	path:REGEX         request path, e.g. path:^/api/v[12]/
+//	url:REGEX          full request url
+//	method:NAME        request method
+//	status:CODE        response status, 404, 4xx or 400-499, also compared, e.g. status>=400
+//	header:NAME        request or response header present, header:NAME=REGEX matches a value
+//	reqheader, respheader   like header, only the request or the response
+//	body:TEXT          decoded request or response body contains TEXT
+//	reqbody, respbody  like body, only the request or the response
+//	type:TEXT          request or response content type contains TEXT
+//	size>SIZE          response body size as captured, e.g. size>=1MB, also :, <, <=, >=
+//	duration>DURATION  time from the request to the complete response, e.g. duration>500ms
+//	conn:ID            client or server conn id
+//	error              failed flows
+//	replay             replayed flows
+//	all                every flow, where an empty expression means none, e.g. in intercept rules
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// Expr is a parsed filter expression, the empty expression matches every flow
+// it marshals to its source, so it can be used in json subscriptions and config files
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses a filter expression, the error of a malformed expression is a *SyntaxError
+func Parse(s string) (*Expr, error) {
+	p := &parser{src: s}
+	p.skipSpace()
+	if p.eof() {
+		return &Expr{src: s}, nil
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		if p.peek() == ')' {
+			return nil, p.errorf(p.pos, "unexpected ')', no '(' to close")
+		}
+		return nil, p.errorf(p.pos, "unexpected %q, expected and, or or the end of the filter", p.word())
+	}
+
+	return &Expr{src: s, root: root}, nil
+}
+
+// MustParse is like Parse but panics on malformed expressions
+func MustParse(s string) *Expr {
+	e, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return e
+}
+
+// Match reports whether the flow matches the expression, a nil Expr matches every flow
+func (e *Expr) Match(flow *model.PacketCaptureFlow) bool {
+	if e == nil || e.root == nil {
+		return true
+	}
+
+	return e.root.match(&view{flow: flow})
+}
+
+// MayMatch reports whether the flow matches the expression or may match it once its bodies are known,
+// the bodies are not read, so it tells whether buffering them is worth it
+func (e *Expr) MayMatch(flow *model.PacketCaptureFlow) bool {
+	if e == nil || e.root == nil {
+		return true
+	}
+
+	return e.root.mayMatch(&view{flow: flow}) != no
+}
+
+// MatchConn reports whether the connection event may carry the matched flows,
+// only the conn terms are known for a connection, so conn:ID and host:x keeps the events of conn ID
+func (e *Expr) MatchConn(conn *model.ConnectionEvent) bool {
+	if e == nil || e.root == nil {
+		return true
+	}
+
+	return e.root.mayMatch(&view{conn: conn}) != no
+}
+
+// Empty reports whether the expression matches every flow
+func (e *Expr) Empty() bool {
+	return e == nil || e.root == nil
+}
+
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+
+	return e.src
+}
+
+func (e *Expr) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *Expr) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*e = *parsed
+
+	return nil
+}
+
+// SyntaxError reports a malformed expression and where it is malformed
+type SyntaxError struct {
+	// the expression
+	Expr string
+
+	// byte offset of the error
+	Pos int
+
+	Msg string
+}
+
+// Error describes the error and points at it under the expression
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid filter: %s at column %d\n  %s\n  %s^", e.Msg, e.Pos+1, e.Expr, strings.Repeat(" ", e.Pos))
+}
+
+// view caches what the terms derive from a flow while it is matched
+// a view of a connection event has no flow
+type view struct {
+	flow *model.PacketCaptureFlow
+	conn *model.ConnectionEvent
+
+	u      *url.URL
+	parsed bool
+
+	reqBody, respBody       []byte
+	reqDecoded, respDecoded bool
+}
+
+func (v *view) url() *url.URL {
+	if !v.parsed {
+		v.parsed = true
+		if v.flow.Request != nil {
+			v.u, _ = url.Parse(v.flow.Request.Url)
+		}
+	}
+
+	return v.u
+}
+
+func (v *view) requestBody() []byte {
+	if !v.reqDecoded && v.flow.Request != nil {
+		v.reqDecoded = true
+		v.reqBody = decode(v.flow.Request.Header, v.flow.Request.Body)
+	}
+
+	return v.reqBody
+}
+
+func (v *view) responseBody() []byte {
+	if !v.respDecoded && v.flow.Response != nil {
+		v.respDecoded = true
+		v.respBody = decode(v.flow.Response.Header, v.flow.Response.Body)
+	}
+
+	return v.respBody
+}
+
+// decode undoes the content encoding, bodies that fail to decode are matched as captured
+func decode(header http.Header, body []byte) []byte {
+	if decoded, err := model.DecodeBody(header, body); err == nil {
+		return decoded
+	}
+
+	return body
+}
@@ -0,0 +1,245 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// testFlow is a GET of https://api.example.com/v1/users answered 404 with a 2KB json body in 300ms
+func testFlow() *model.PacketCaptureFlow {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	body := `{"error":"not found"}`
+	return &model.PacketCaptureFlow{
+		ID: "flow",
+		Request: &model.Request{
+			Method: http.MethodGet,
+			Url:    "https://api.example.com/v1/users?page=2",
+			Header: http.Header{"Accept": {"application/json"}},
+		},
+		Response: &model.Response{
+			StatusCode: http.StatusNotFound,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       []byte(body + strings.Repeat(" ", 2048-len(body))),
+		},
+		Timing: &model.Timing{
+			RequestStart:     start,
+			ResponseComplete: start.Add(300 * time.Millisecond),
+		},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"host:api.example.com", true},
+		{"host:*.example.com", true},
+		{"host:example.com", false},
+		{"path:^/v1/", true},
+		{"method:get", true},
+		{"type:json", true},
+		{"body:\"not found\"", true},
+		{"reqbody:found", false},
+
+		// precedence, and binds tighter than or, not tighter than and
+		{"method:POST and host:x or path:users", true},
+		{"method:POST and (host:x or path:users)", false},
+		{"path:users or host:x and method:POST", true},
+		{"(path:users or host:x) and method:POST", false},
+		{"not method:POST and path:users", true},
+		{"not (method:GET and path:users)", false},
+		{"!method:POST !host:x", true},
+		{"method:GET && (status:5xx || status:4xx)", true},
+		{"method:GET path:users", true},
+		{"method:GET path:orders", false},
+
+		// status codes, classes and ranges
+		{"status:404", true},
+		{"status:4xx", true},
+		{"status:4XX", true},
+		{"status:5xx", false},
+		{"status:400-499", true},
+		{"status:405-499", false},
+		{"status>=400", true},
+		{"status >= 400", true},
+		{"status>404", false},
+		{"status<500", true},
+		{"status<=403", false},
+
+		// sizes and durations
+		{"size>1k", true},
+		{"size>=2KB", true},
+		{"size>2KB", false},
+		{"size<1.5mb", true},
+		{"size:2048", true},
+		{"duration>200ms", true},
+		{"duration>=300ms", true},
+		{"duration<0.3s", false},
+		{"duration<1s", true},
+	}
+
+	flow := testFlow()
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			if got := e.Match(flow); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchIncompleteFlow(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"status:4xx", false},
+		{"not status:4xx", true},
+		{"size<1k", false},
+		{"duration<1s", false},
+		{"respheader:Content-Type", false},
+	}
+
+	flow := testFlow()
+	flow.Response, flow.Timing = nil, nil
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := MustParse(tt.expr).Match(flow); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMayMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"host:api.example.com", true},
+		{"host:x", false},
+		{"body:anything", true},
+		{"not body:anything", true},
+		{"host:x and body:anything", false},
+		{"host:x or body:anything", true},
+		{"not (host:api.example.com or body:anything)", false},
+		{"size>1GB", true},
+		{"method:POST and size>1GB", false},
+	}
+
+	flow := testFlow()
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := MustParse(tt.expr).MayMatch(flow); got != tt.want {
+				t.Errorf("MayMatch(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{"stauts:404", 0, `unknown field "stauts", did you mean "status"?`},
+		{"method:GET and hots:x", 15, `unknown field "hots", did you mean "host"?`},
+		{"xyzzy:1", 0, `unknown field "xyzzy", want one of all, body, conn,`},
+		{"(host:x", 0, "unclosed '('"},
+		{"host:x)", 6, "unexpected ')', no '(' to close"},
+		{"host:x and", 10, "unexpected end of the filter, expected a term"},
+		{"and host:x", 0, "unexpected and, expected a term like host:example.com"},
+		{"host", 4, "host needs an operator and a value, e.g. host:*.example.com"},
+		{"host:", 5, "missing value for host"},
+		{"error:1", 5, "error takes no value"},
+		{"method>GET", 6, `method does not support ">"`},
+		{"status:6xx", 7, `status: invalid status class "6xx", want 1xx to 5xx`},
+		{"status:499-400", 7, `status: invalid status range "499-400"`},
+		{"status>=abc", 8, `status: invalid status "abc"`},
+		{"size>lots", 5, `size: invalid size "lots"`},
+		{"size>-1k", 5, `size: invalid size "-1k"`},
+		{"duration>soon", 9, `duration: invalid duration "soon"`},
+		{"path:(", 5, `path: invalid regexp "(": missing closing )`},
+		{"path:'['", 5, `path: invalid regexp "["`},
+		{`host:"x`, 5, "unterminated quote"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Parse(%q) error = %v, want a *SyntaxError", tt.expr, err)
+			}
+			if syntaxErr.Pos != tt.pos || !strings.HasPrefix(syntaxErr.Msg, tt.msg) {
+				t.Errorf("Parse(%q) error at %d %q, want at %d %q", tt.expr, syntaxErr.Pos, syntaxErr.Msg, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorPointsAtColumn(t *testing.T) {
+	_, err := Parse("method:GET and hots:x")
+	want := "invalid filter: unknown field \"hots\", did you mean \"host\"? at column 16\n" +
+		"  method:GET and hots:x\n" +
+		"                 ^"
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
+
+func TestExprText(t *testing.T) {
+	const src = "host:*.example.com and status>=400"
+	var e Expr
+	if err := e.UnmarshalText([]byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	text, err := e.MarshalText()
+	if err != nil || string(text) != src {
+		t.Errorf("MarshalText() = %q, %v, want %q", text, err, src)
+	}
+
+	var nilExpr *Expr
+	if !nilExpr.Empty() || !nilExpr.Match(testFlow()) || nilExpr.String() != "" {
+		t.Error("nil Expr should be empty and match every flow")
+	}
+}
+
+func TestMatchConn(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"host:x", true},
+		{"conn:server", true},
+		{"conn:client", true},
+		{"conn:other", false},
+		{"conn:other and host:x", false},
+		{"conn:other or host:x", true},
+		{"not conn:server", false},
+		{"conn:server and not host:x", true},
+	}
+
+	conn := &model.ConnectionEvent{Side: "server", ID: "server", ClientConnID: "client"}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := MustParse(tt.expr).MatchConn(conn); got != tt.want {
+				t.Errorf("MatchConn(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
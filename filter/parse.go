@@ -0,0 +1,378 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node is a parsed expression
+type node interface {
+	match(v *view) bool
+
+	// matches without reading the bodies
+	mayMatch(v *view) maybe
+}
+
+// maybe is the result of matching without the bodies
+type maybe int
+
+const (
+	no maybe = iota
+	yes
+	// depends on the bodies
+	unknown
+)
+
+type andNode struct{ left, right node }
+
+func (n *andNode) match(v *view) bool { return n.left.match(v) && n.right.match(v) }
+
+func (n *andNode) mayMatch(v *view) maybe {
+	left := n.left.mayMatch(v)
+	if left == no {
+		return no
+	}
+	right := n.right.mayMatch(v)
+	if right == no {
+		return no
+	}
+
+	return max(left, right)
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) match(v *view) bool { return n.left.match(v) || n.right.match(v) }
+
+func (n *orNode) mayMatch(v *view) maybe {
+	left := n.left.mayMatch(v)
+	if left == yes {
+		return yes
+	}
+	right := n.right.mayMatch(v)
+	if right == yes {
+		return yes
+	}
+
+	return max(left, right)
+}
+
+type notNode struct{ node node }
+
+func (n *notNode) match(v *view) bool { return !n.node.match(v) }
+
+func (n *notNode) mayMatch(v *view) maybe {
+	switch n.node.mayMatch(v) {
+	case yes:
+		return no
+	case no:
+		return yes
+	}
+
+	return unknown
+}
+
+// term is a parsed field term
+type term func(v *view) bool
+
+func (t term) match(v *view) bool { return t(v) }
+
+func (t term) mayMatch(v *view) maybe {
+	// connection views only know the conn ids
+	if v.flow == nil {
+		return unknown
+	}
+	if t(v) {
+		return yes
+	}
+
+	return no
+}
+
+// bodyNode is a term reading the bodies
+type bodyNode struct{ term }
+
+func (bodyNode) mayMatch(*view) maybe { return unknown }
+
+// connNode is a conn term, also matched against connection events
+type connNode struct {
+	term
+	id string
+}
+
+func (n connNode) mayMatch(v *view) maybe {
+	if v.flow != nil {
+		return n.term.mayMatch(v)
+	}
+	if v.conn.ID == n.id || v.conn.ClientConnID == n.id {
+		return yes
+	}
+
+	return no
+}
+
+// parser is a recursive descent parser over the expression source
+//
+//	or   = and { ("or" | "|" | "||") and }
+//	and  = not { ["and" | "&" | "&&"] not }
+//	not  = ("not" | "!") not | "(" or ")" | term
+//	term = field [op value]
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpace()
+		if !p.acceptOp("||", "|") && !p.acceptWord("or") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpace()
+		if p.eof() || p.peek() == ')' || p.peek() == '|' || p.atWord("or") {
+			return left, nil
+		}
+		// adjacent terms are and-ed too
+		if !p.acceptOp("&&", "&") {
+			p.acceptWord("and")
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	p.skipSpace()
+	if p.acceptOp("!") || p.acceptWord("not") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+
+	if p.acceptOp("(") {
+		open := p.pos - 1
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.acceptOp(")") {
+			return nil, p.errorf(open, "unclosed '('")
+		}
+		return n, nil
+	}
+
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (node, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.eof() {
+		return nil, p.errorf(start, "unexpected end of the filter, expected a term")
+	}
+
+	for !p.eof() && (isIdent(p.peek())) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if len(name) == 0 {
+		return nil, p.errorf(start, "unexpected %q, expected a term like host:example.com", p.word())
+	}
+	switch strings.ToLower(name) {
+	case "and", "or", "not":
+		return nil, p.errorf(start, "unexpected %s, expected a term like host:example.com", name)
+	}
+	f, ok := fields[strings.ToLower(name)]
+	if !ok {
+		return nil, p.errorf(start, "%s", unknownField(name))
+	}
+
+	// the operator may be surrounded by spaces, e.g. status >= 400
+	save := p.pos
+	p.skipSpace()
+	opPos := p.pos
+	op := p.readOp()
+	if len(op) == 0 {
+		p.pos = save
+		if !f.noValue {
+			return nil, p.errorf(opPos, "%s needs an operator and a value, e.g. %s", f.name, f.usage)
+		}
+		t, _ := f.build("", "")
+		return t, nil
+	}
+	if f.noValue {
+		return nil, p.errorf(opPos, "%s takes no value", f.name)
+	}
+	if !strings.Contains(f.ops, " "+op+" ") {
+		return nil, p.errorf(opPos, "%s does not support %q, e.g. %s", f.name, op, f.usage)
+	}
+
+	p.skipSpace()
+	valuePos := p.pos
+	value, err := p.readValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, p.errorf(valuePos, "missing value for %s, e.g. %s", f.name, f.usage)
+	}
+
+	t, err := f.build(op, value)
+	if err != nil {
+		return nil, p.errorf(valuePos, "%s: %v", f.name, err)
+	}
+	if f.body {
+		return bodyNode{t}, nil
+	}
+	if f.conn {
+		return connNode{t, value}, nil
+	}
+
+	return t, nil
+}
+
+// readOp reads a comparison operator, ":" and "=" both mean equal
+func (p *parser) readOp() string {
+	for _, op := range []string{">=", "<=", ":", "=", ">", "<"} {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			p.pos += len(op)
+			if op == "=" {
+				return ":"
+			}
+			return op
+		}
+	}
+
+	return ""
+}
+
+// readValue reads a quoted value or a bare one ending at a space or ')'
+func (p *parser) readValue() (string, error) {
+	if p.eof() {
+		return "", nil
+	}
+
+	start := p.pos
+	if q := p.peek(); q == '"' || q == '\'' {
+		for p.pos++; !p.eof(); p.pos++ {
+			switch p.src[p.pos] {
+			case '\\':
+				p.pos++
+			case q:
+				p.pos++
+				raw := p.src[start:p.pos]
+				if q == '\'' {
+					// single quotes are taken literally
+					return raw[1 : len(raw)-1], nil
+				}
+				value, err := strconv.Unquote(raw)
+				if err != nil {
+					return "", p.errorf(start, "invalid quoted value %s", raw)
+				}
+				return value, nil
+			}
+		}
+		return "", p.errorf(start, "unterminated quote")
+	}
+
+	for !p.eof() && !unicode.IsSpace(rune(p.peek())) && p.peek() != ')' {
+		p.pos++
+	}
+
+	return p.src[start:p.pos], nil
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.peek())) {
+		p.pos++
+	}
+}
+
+// acceptOp consumes the first of ops found at the position
+func (p *parser) acceptOp(ops ...string) bool {
+	for _, op := range ops {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			p.pos += len(op)
+			return true
+		}
+	}
+
+	return false
+}
+
+// atWord reports whether the keyword w is at the position
+func (p *parser) atWord(w string) bool {
+	rest := p.src[p.pos:]
+	if len(rest) < len(w) || !strings.EqualFold(rest[:len(w)], w) {
+		return false
+	}
+
+	return len(rest) == len(w) || !isIdent(rest[len(w)]) && rest[len(w)] != ':'
+}
+
+func (p *parser) acceptWord(w string) bool {
+	if !p.atWord(w) {
+		return false
+	}
+	p.pos += len(w)
+
+	return true
+}
+
+// word returns the text at the position up to the next space, for error messages
+func (p *parser) word() string {
+	end := p.pos
+	for end < len(p.src) && !unicode.IsSpace(rune(p.src[end])) {
+		end++
+	}
+
+	return p.src[p.pos:end]
+}
+
+func (p *parser) errorf(pos int, format string, args ...any) error {
+	return &SyntaxError{
+		Expr: p.src,
+		Pos:  pos,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+func isIdent(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
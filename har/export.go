@@ -0,0 +1,313 @@
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// New converts flows to a HAR log, keeping their order
+func New(flows []*model.PacketCaptureFlow) *HAR {
+	creator := &Creator{Name: "mitmfoxy", Version: "devel"}
+	if info, ok := debug.ReadBuildInfo(); ok && len(info.Main.Version) > 0 {
+		creator.Version = info.Main.Version
+	}
+
+	entries := make([]*Entry, 0, len(flows))
+	for _, flow := range flows {
+		entries = append(entries, NewEntry(flow))
+	}
+
+	return &HAR{
+		Log: &Log{
+			Version: Version,
+			Creator: creator,
+			Entries: entries,
+		},
+	}
+}
+
+// Write writes flows to w as HAR
+func Write(w io.Writer, flows []*model.PacketCaptureFlow) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(New(flows))
+}
+
+// WriteFile writes flows to the named file as HAR
+// the file is replaced atomically so readers never see a partial log
+func WriteFile(name string, flows []*model.PacketCaptureFlow) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := Write(f, flows); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+// NewEntry converts a flow, a failed flow without response gets status 0 like browsers report it
+func NewEntry(flow *model.PacketCaptureFlow) *Entry {
+	httpVersion := "HTTP/1.1"
+	if flow.Response != nil && len(flow.Response.Proto) > 0 {
+		httpVersion = flow.Response.Proto
+	}
+
+	entry := &Entry{
+		Request:  newRequest(flow.Request, httpVersion),
+		Response: newResponse(flow.Response, httpVersion),
+		Timings:  &Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+		ID:       flow.ID,
+		Error:    flow.Error,
+	}
+	if flow.ServerConn != nil {
+		if host, _, err := net.SplitHostPort(flow.ServerConn.RemoteAddr); err == nil {
+			entry.ServerIPAddress = host
+		}
+		entry.Connection = flow.ServerConn.ID
+	}
+	if flow.Timing != nil {
+		entry.StartedDateTime = flow.Timing.RequestStart
+		// har phases follow the start, tunnels dial before the request, so their entries start at the dial
+		if t := flow.Timing; !t.ConnectReceived.IsZero() {
+			entry.StartedDateTime = t.RequestStart.Add(-(t.DNS + t.TCPConnect + t.UpstreamTLS))
+		}
+		entry.Timings = newTimings(flow.Timing)
+		for _, t := range []float64{entry.Timings.DNS, entry.Timings.Connect, entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive} {
+			entry.Time += max(t, 0)
+		}
+	}
+
+	return entry
+}
+
+func newTimings(t *model.Timing) *Timings {
+	timings := &Timings{
+		Blocked: -1,
+		DNS:     optional(t.DNS),
+		Connect: optional(t.TCPConnect + t.UpstreamTLS),
+		SSL:     optional(t.UpstreamTLS),
+		Send:    span(t.RequestStart, t.RequestSent),
+		Wait:    span(t.RequestSent, t.FirstResponseByte),
+		Receive: span(t.FirstResponseByte, t.ResponseComplete),
+	}
+
+	// plain http dials while sending, tunnels dial before the request
+	if t.ConnectReceived.IsZero() {
+		timings.Send = max(timings.Send-milliseconds(t.DNS+t.TCPConnect+t.UpstreamTLS), 0)
+	}
+	// answered without going upstream
+	if t.RequestSent.IsZero() {
+		timings.Receive = span(t.RequestStart, t.ResponseComplete)
+	}
+
+	return timings
+}
+
+func newRequest(r *model.Request, httpVersion string) *Request {
+	req := &Request{
+		HTTPVersion: httpVersion,
+		Cookies:     []*Cookie{},
+		Headers:     []*NameValue{},
+		QueryString: []*NameValue{},
+		HeadersSize: -1,
+	}
+	if r == nil {
+		return req
+	}
+
+	req.Method = r.Method
+	req.URL = r.Url
+	req.Cookies = newCookies((&http.Request{Header: r.Header}).Cookies())
+	req.Headers = newHeaders(r.Header)
+	if u, err := url.Parse(r.Url); err == nil {
+		req.QueryString = parseQuery(u.RawQuery)
+	}
+	req.BodySize = len(r.Body)
+	if len(r.Body) > 0 {
+		req.PostData = newPostData(r.Header, r.Body)
+	}
+
+	return req
+}
+
+func newResponse(r *model.Response, httpVersion string) *Response {
+	resp := &Response{
+		HTTPVersion: httpVersion,
+		Cookies:     []*Cookie{},
+		Headers:     []*NameValue{},
+		Content:     &Content{MimeType: "x-unknown"},
+		HeadersSize: -1,
+	}
+	if r == nil {
+		return resp
+	}
+
+	resp.Status = r.StatusCode
+	resp.StatusText = r.StatusText
+	resp.Cookies = newCookies(r.Cookies)
+	resp.Headers = newHeaders(r.Header)
+	resp.RedirectURL = r.Header.Get("Location")
+	resp.BodySize = len(r.Body)
+
+	// content is the decoded body, an undecodable one is kept as captured
+	body := r.Body
+	if decoded, err := model.DecodeBody(r.Header, r.Body); err == nil {
+		body = decoded
+		resp.Content.Compression = len(decoded) - len(r.Body)
+	}
+	if contentType := r.Header.Get("Content-Type"); len(contentType) > 0 {
+		resp.Content.MimeType = contentType
+	}
+	resp.Content.Size = len(body)
+	resp.Content.Text, resp.Content.Encoding = newText(body)
+
+	return resp
+}
+
+func newPostData(header http.Header, body []byte) *PostData {
+	contentType := header.Get("Content-Type")
+	postData := &PostData{
+		MimeType: contentType,
+		Params:   []*Param{},
+	}
+	postData.Text, postData.Encoding = newText(body)
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		for _, nv := range parseQuery(string(body)) {
+			postData.Params = append(postData.Params, &Param{Name: nv.Name, Value: nv.Value})
+		}
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			param := &Param{
+				Name:        part.FormName(),
+				FileName:    part.FileName(),
+				ContentType: part.Header.Get("Content-Type"),
+			}
+			if len(param.FileName) == 0 {
+				value, _ := io.ReadAll(part)
+				param.Value = string(value)
+			}
+			postData.Params = append(postData.Params, param)
+		}
+	}
+
+	return postData
+}
+
+// newHeaders lists the header fields sorted by name
+func newHeaders(header http.Header) []*NameValue {
+	headers := []*NameValue{}
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, value := range header[name] {
+			headers = append(headers, &NameValue{Name: name, Value: value})
+		}
+	}
+
+	return headers
+}
+
+func newCookies(cookies []*http.Cookie) []*Cookie {
+	harCookies := []*Cookie{}
+	for _, c := range cookies {
+		cookie := &Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.UTC().Format(time.RFC3339)
+		}
+		harCookies = append(harCookies, cookie)
+	}
+
+	return harCookies
+}
+
+// parseQuery splits a query in order, keeping repeated and malformed pairs
+func parseQuery(query string) []*NameValue {
+	pairs := []*NameValue{}
+	for pair := range strings.SplitSeq(query, "&") {
+		if len(pair) == 0 {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		pairs = append(pairs, &NameValue{Name: name, Value: value})
+	}
+
+	return pairs
+}
+
+// newText returns body as text, base64 encoded unless it is utf-8
+func newText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// optional converts a connection phase, which is zero when it did not happen
+func optional(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+
+	return milliseconds(d)
+}
+
+func span(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+
+	return milliseconds(to.Sub(from))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,128 @@
+package har
+
+import "time"
+
+// HAR 1.2, http://www.softwareishard.com/blog/har-12-spec/
+// fields prefixed with _ are mitmfoxy extensions the spec allows
+
+const Version = "1.2"
+
+type HAR struct {
+	Log *Log `json:"log"`
+}
+
+type Log struct {
+	Version string   `json:"version"`
+	Creator *Creator `json:"creator"`
+	Entries []*Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+
+	// total elapsed milliseconds, the sum of the non negative timings
+	Time float64 `json:"time"`
+
+	Request  *Request  `json:"request"`
+	Response *Response `json:"response"`
+	Cache    struct{}  `json:"cache"`
+	Timings  *Timings  `json:"timings"`
+
+	ServerIPAddress string `json:"serverIPAddress,omitempty"`
+
+	// id of the upstream conn
+	Connection string `json:"connection,omitempty"`
+
+	// flow id
+	ID string `json:"_id,omitempty"`
+
+	// why the flow failed
+	Error string `json:"_error,omitempty"`
+}
+
+type Request struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*Cookie    `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	QueryString []*NameValue `json:"queryString"`
+	PostData    *PostData    `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*Cookie    `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	Content     *Content     `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string   `json:"mimeType"`
+	Params   []*Param `json:"params"`
+	Text     string   `json:"text"`
+
+	// base64 when the body is not utf-8 text
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type Param struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type Content struct {
+	// decoded body size
+	Size int `json:"size"`
+
+	// bytes saved by the content encoding
+	Compression int `json:"compression,omitempty"`
+
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+
+	// base64 when the body is not utf-8 text
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Timings are in milliseconds, -1 when a phase does not apply, e.g. dns on a reused conn
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+
+	// included in connect
+	SSL float64 `json:"ssl"`
+}
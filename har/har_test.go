@@ -0,0 +1,182 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// ms is n milliseconds
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestTimingRoundTrip(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		timing *model.Timing
+		want   Timings
+	}{
+		{
+			// dials while sending
+			"plain http",
+			&model.Timing{
+				DNS: ms(5), TCPConnect: ms(10),
+				RequestStart:      start,
+				RequestSent:       start.Add(ms(20)),
+				FirstResponseByte: start.Add(ms(120)),
+				ResponseComplete:  start.Add(ms(150)),
+			},
+			Timings{Blocked: -1, DNS: 5, Connect: 10, SSL: -1, Send: 5, Wait: 100, Receive: 30},
+		},
+		{
+			"reused conn",
+			&model.Timing{
+				RequestStart:      start,
+				RequestSent:       start.Add(ms(2)),
+				FirstResponseByte: start.Add(ms(50)),
+				ResponseComplete:  start.Add(ms(60)),
+			},
+			Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 2, Wait: 48, Receive: 10},
+		},
+		{
+			// dials before the request
+			"tunnel",
+			&model.Timing{
+				ConnectReceived: start.Add(-ms(100)),
+				DNS:             ms(5), TCPConnect: ms(10), UpstreamTLS: ms(20),
+				RequestStart:      start,
+				RequestSent:       start.Add(ms(3)),
+				FirstResponseByte: start.Add(ms(53)),
+				ResponseComplete:  start.Add(ms(60)),
+			},
+			Timings{Blocked: -1, DNS: 5, Connect: 30, SSL: 20, Send: 3, Wait: 50, Receive: 7},
+		},
+		{
+			"answered by the proxy",
+			&model.Timing{
+				RequestStart:     start,
+				ResponseComplete: start.Add(ms(4)),
+			},
+			Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 0, Wait: 0, Receive: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow := &model.PacketCaptureFlow{
+				ID:       "flow",
+				Request:  &model.Request{Method: http.MethodGet, Url: "https://example.com/"},
+				Response: &model.Response{StatusCode: 200, StatusText: "OK", Header: http.Header{}},
+				Timing:   tt.timing,
+			}
+			entry := NewEntry(flow)
+			if *entry.Timings != tt.want {
+				t.Errorf("timings = %+v, want %+v", *entry.Timings, tt.want)
+			}
+			// the phases follow each other from the start
+			end := entry.StartedDateTime.Add(time.Duration(entry.Time * float64(time.Millisecond)))
+			if !end.Equal(tt.timing.ResponseComplete) {
+				t.Errorf("started %v and took %vms, ending at %v, want %v", entry.StartedDateTime, entry.Time, end, tt.timing.ResponseComplete)
+			}
+
+			got, err := entry.Flow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, pair := range map[string][2]time.Time{
+				"request_sent":        {got.Timing.RequestSent, tt.timing.RequestSent},
+				"first_response_byte": {got.Timing.FirstResponseByte, tt.timing.FirstResponseByte},
+				"response_complete":   {got.Timing.ResponseComplete, tt.timing.ResponseComplete},
+			} {
+				if !pair[0].Equal(pair[1]) && !pair[1].IsZero() {
+					t.Errorf("imported %s = %v, want %v", name, pair[0], pair[1])
+				}
+			}
+			if !got.Timing.RequestStart.Equal(entry.StartedDateTime) {
+				t.Errorf("imported request_start = %v, want the entry start %v", got.Timing.RequestStart, entry.StartedDateTime)
+			}
+			if got.Timing.DNS != tt.timing.DNS || got.Timing.TCPConnect != tt.timing.TCPConnect || got.Timing.UpstreamTLS != tt.timing.UpstreamTLS {
+				t.Errorf("imported dial phases = %v %v %v, want %v %v %v",
+					got.Timing.DNS, got.Timing.TCPConnect, got.Timing.UpstreamTLS, tt.timing.DNS, tt.timing.TCPConnect, tt.timing.UpstreamTLS)
+			}
+		})
+	}
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(`{"ok":true}`))
+	zw.Close()
+
+	expires := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	flow := &model.PacketCaptureFlow{
+		ID: "flow",
+		Request: &model.Request{
+			Method: http.MethodPost,
+			Url:    "https://example.com/upload?a=1",
+			Header: http.Header{"Content-Type": {"application/octet-stream"}, "X-A": {"1", "2"}},
+			Body:   []byte{0xff, 0x00, 0xfe},
+		},
+		Response: &model.Response{
+			Proto:      "HTTP/2.0",
+			StatusCode: http.StatusCreated,
+			StatusText: "Created",
+			Header:     http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}, "Content-Length": {"31"}},
+			Body:       gzipped.Bytes(),
+			Cookies:    []*http.Cookie{{Name: "session", Value: "abc", Path: "/", HttpOnly: true, Secure: true, Expires: expires}},
+		},
+		ServerConn: &model.ConnInfo{ID: "server", RemoteAddr: "93.184.216.34:443"},
+	}
+
+	got, err := NewEntry(flow).Flow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != flow.ID || !reflect.DeepEqual(got.Request, flow.Request) {
+		t.Errorf("request = %s %+v, want %s %+v", got.ID, got.Request, flow.ID, flow.Request)
+	}
+	// har content is decoded, so the content encoding is dropped
+	want := &model.Response{
+		Proto:      "HTTP/2.0",
+		StatusCode: http.StatusCreated,
+		StatusText: "Created",
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       []byte(`{"ok":true}`),
+		Cookies:    flow.Response.Cookies,
+	}
+	if !reflect.DeepEqual(got.Response, want) {
+		t.Errorf("response = %+v, want %+v", got.Response, want)
+	}
+	if got.ServerConn == nil || got.ServerConn.ID != "server" || got.ServerConn.RemoteAddr != "93.184.216.34" {
+		t.Errorf("server conn = %+v, want server at 93.184.216.34", got.ServerConn)
+	}
+}
+
+func TestFailedEntryRoundTrip(t *testing.T) {
+	flow := &model.PacketCaptureFlow{
+		ID:      "failed",
+		Request: &model.Request{Method: http.MethodGet, Url: "http://example.com/", Header: http.Header{}},
+		Error:   "connection refused",
+	}
+
+	entry := NewEntry(flow)
+	if entry.Response.Status != 0 {
+		t.Errorf("status = %d, want 0 for a failed flow", entry.Response.Status)
+	}
+	got, err := entry.Flow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Response != nil || got.Error != flow.Error {
+		t.Errorf("imported response %+v, error %q, want none and %q", got.Response, got.Error, flow.Error)
+	}
+}
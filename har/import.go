@@ -0,0 +1,201 @@
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/google/uuid"
+)
+
+// Read decodes a HAR log
+func Read(r io.Reader) (*HAR, error) {
+	var h HAR
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+	if h.Log == nil {
+		return nil, errors.New("not a har file, missing log")
+	}
+
+	return &h, nil
+}
+
+// Flows converts the entries to flows, keeping their order
+func (h *HAR) Flows() ([]*model.PacketCaptureFlow, error) {
+	flows := make([]*model.PacketCaptureFlow, 0, len(h.Log.Entries))
+	for i, entry := range h.Log.Entries {
+		flow, err := entry.Flow()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		flows = append(flows, flow)
+	}
+
+	return flows, nil
+}
+
+// Flow converts the entry to a flow, the inverse of NewEntry
+// browsers record decoded content, so the content encoding is dropped from the response headers
+// to keep them consistent with the body. Entries without _id get a new flow id
+func (e *Entry) Flow() (*model.PacketCaptureFlow, error) {
+	if e.Request == nil {
+		return nil, errors.New("missing request")
+	}
+
+	flow := &model.PacketCaptureFlow{
+		ID:    e.ID,
+		Error: e.Error,
+	}
+	if len(flow.ID) == 0 {
+		flow.ID = uuid.NewString()
+	}
+
+	req, err := e.Request.request()
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	flow.Request = req
+
+	if e.Response != nil && e.Response.Status > 0 {
+		resp, err := e.Response.response()
+		if err != nil {
+			return nil, fmt.Errorf("response: %w", err)
+		}
+		flow.Response = resp
+	}
+
+	if len(e.ServerIPAddress) > 0 {
+		flow.ServerConn = &model.ConnInfo{
+			ID:         e.Connection,
+			RemoteAddr: e.ServerIPAddress,
+		}
+	}
+	if e.Timings != nil {
+		flow.Timing = e.Timings.timing(e.StartedDateTime)
+	}
+
+	return flow, nil
+}
+
+func (r *Request) request() (*model.Request, error) {
+	if _, err := url.Parse(r.URL); err != nil {
+		return nil, err
+	}
+
+	req := &model.Request{
+		Method: r.Method,
+		Url:    r.URL,
+		Header: header(r.Headers),
+	}
+	if r.PostData != nil {
+		body, err := text(r.PostData.Text, r.PostData.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("post data: %w", err)
+		}
+		// some producers only record the params of forms
+		if len(body) == 0 && len(r.PostData.Params) > 0 {
+			form := make(url.Values)
+			for _, p := range r.PostData.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = []byte(form.Encode())
+		}
+		req.Body = body
+	}
+
+	return req, nil
+}
+
+func (r *Response) response() (*model.Response, error) {
+	resp := &model.Response{
+		Proto:      r.HTTPVersion,
+		StatusCode: r.Status,
+		StatusText: r.StatusText,
+		Header:     header(r.Headers),
+	}
+	if len(resp.StatusText) == 0 {
+		resp.StatusText = http.StatusText(r.Status)
+	}
+
+	if r.Content != nil {
+		body, err := text(r.Content.Text, r.Content.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("content: %w", err)
+		}
+		resp.Body = body
+	}
+	if len(resp.Header.Get("Content-Encoding")) > 0 {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+
+	for _, c := range r.Cookies {
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HttpOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+		}
+		if expires, err := time.Parse(time.RFC3339, c.Expires); err == nil {
+			cookie.Expires = expires
+		}
+		resp.Cookies = append(resp.Cookies, cookie)
+	}
+
+	return resp, nil
+}
+
+// timing rebuilds the timing of a flow started at start from its phases
+func (t *Timings) timing(start time.Time) *model.Timing {
+	duration := func(ms float64) time.Duration {
+		return time.Duration(max(ms, 0) * float64(time.Millisecond))
+	}
+
+	timing := &model.Timing{
+		DNS:          duration(t.DNS),
+		TCPConnect:   duration(t.Connect - max(t.SSL, 0)),
+		UpstreamTLS:  duration(t.SSL),
+		RequestStart: start,
+	}
+	if start.IsZero() {
+		return timing
+	}
+
+	sent := start.Add(duration(t.Blocked) + duration(t.DNS) + duration(t.Connect) + duration(t.Send))
+	timing.RequestSent = sent
+	timing.FirstResponseByte = sent.Add(duration(t.Wait))
+	timing.ResponseComplete = timing.FirstResponseByte.Add(duration(t.Receive))
+
+	return timing
+}
+
+// header builds a header from the fields, http/2 pseudo headers are dropped
+func header(fields []*NameValue) http.Header {
+	h := make(http.Header)
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+		h.Add(f.Name, f.Value)
+	}
+
+	return h
+}
+
+func text(s, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+
+	return []byte(s), nil
+}
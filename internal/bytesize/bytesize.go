@@ -0,0 +1,36 @@
+package bytesize
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// units by suffix, binary and case insensitive
+var units = []struct {
+	suffix string
+	size   float64
+}{
+	{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1},
+}
+
+// Parse parses a byte size with an optional binary unit, e.g. 512, 10k, 1.5MB or 64MB
+func Parse(s string) (int64, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	for _, unit := range units {
+		if n, ok := strings.CutSuffix(num, unit.suffix); ok {
+			num, scale = n, unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) || n*scale > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q, want e.g. 512, 10k or 64MB", s)
+	}
+
+	return int64(n * scale), nil
+}
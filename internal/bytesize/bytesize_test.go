@@ -0,0 +1,38 @@
+package bytesize
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512b", 512},
+		{"10k", 10 << 10},
+		{"10K", 10 << 10},
+		{"10kb", 10 << 10},
+		{"1.5MB", 3 << 19},
+		{"64 mb", 64 << 20},
+		{" 2g ", 2 << 30},
+		{"1GB", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := Parse(tt.s)
+			if err != nil || got != tt.want {
+				t.Errorf("Parse(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, s := range []string{"", "k", "lots", "-1k", "1tb", "NaN", "inf", "1e30gb", "1 k b"} {
+		if n, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) = %d, want an error", s, n)
+		}
+	}
+}
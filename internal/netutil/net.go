@@ -1,6 +1,7 @@
 package netutil
 
 import (
+	"fmt"
 	"net"
 	"net/url"
 )
@@ -21,3 +22,21 @@ func JoinHostPort(u *url.URL) string {
 
 	return net.JoinHostPort(u.Hostname(), port)
 }
+
+// LoopbackAddr returns addr if its host is a loopback address, an empty host binds 127.0.0.1
+func LoopbackAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch ip := net.ParseIP(host); {
+	case len(host) == 0:
+		host = "127.0.0.1"
+	case host == "localhost":
+	case ip == nil || !ip.IsLoopback():
+		return "", fmt.Errorf("%s is not a loopback address", addr)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,107 @@
+package urlpattern
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/internal/netutil"
+)
+
+// Pattern matches request urls by scheme, host, port and path prefix
+type Pattern struct {
+	src string
+
+	// empty matches any scheme
+	scheme string
+
+	// lower case glob
+	host string
+
+	// empty matches any port
+	port string
+
+	// path prefix, matched at segment boundaries unless it ends with a slash
+	prefix string
+}
+
+// Parse parses [scheme://]host[:port][/path], the host is a glob and the path a prefix,
+// e.g. *.example.com/static/ or https://api.example.com:8443/v1
+func Parse(s string) (*Pattern, error) {
+	p := &Pattern{src: s}
+
+	rest := s
+	if scheme, after, ok := strings.Cut(rest, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid url pattern %q, scheme must be http or https", s)
+		}
+		p.scheme, rest = scheme, after
+	}
+
+	hostport, prefix := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hostport, prefix = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(hostport, ":"); i >= 0 && !strings.HasSuffix(hostport, "]") {
+		hostport, p.port = hostport[:i], hostport[i+1:]
+	}
+	// unbracket ipv6 literals, other brackets are glob classes
+	if inner, ok := strings.CutPrefix(hostport, "["); ok && strings.HasSuffix(inner, "]") && strings.Contains(inner, ":") {
+		hostport = strings.TrimSuffix(inner, "]")
+	}
+	p.host = strings.ToLower(hostport)
+	if len(p.host) == 0 {
+		return nil, fmt.Errorf("invalid url pattern %q, missing host", s)
+	}
+	if _, err := path.Match(p.host, ""); err != nil {
+		return nil, fmt.Errorf("invalid url pattern %q, bad host glob", s)
+	}
+	p.prefix = prefix
+
+	return p, nil
+}
+
+// Match reports whether u matches, and returns the path below the prefix
+func (p *Pattern) Match(u *url.URL) (string, bool) {
+	if len(p.scheme) > 0 && u.Scheme != p.scheme {
+		return "", false
+	}
+	if ok, _ := path.Match(p.host, strings.ToLower(u.Hostname())); !ok {
+		return "", false
+	}
+	if len(p.port) > 0 {
+		if _, port, _ := net.SplitHostPort(netutil.JoinHostPort(u)); port != p.port {
+			return "", false
+		}
+	}
+
+	// /static/ matches /static too
+	if len(p.prefix) > 1 && u.Path == strings.TrimSuffix(p.prefix, "/") {
+		return "", true
+	}
+	rest, ok := strings.CutPrefix(u.Path, p.prefix)
+	if !ok {
+		return "", false
+	}
+	// /static matches /static and /static/app.js but not /statical
+	if len(rest) > 0 && len(p.prefix) > 0 && !strings.HasSuffix(p.prefix, "/") && rest[0] != '/' {
+		return "", false
+	}
+
+	return rest, true
+}
+
+// MatchesOrigin reports whether every url of the origin scheme://hostport matches
+func (p *Pattern) MatchesOrigin(scheme, hostport string) bool {
+	if len(p.prefix) > 0 && p.prefix != "/" {
+		return false
+	}
+	_, ok := p.Match(&url.URL{Scheme: scheme, Host: hostport, Path: "/"})
+	return ok
+}
+
+func (p *Pattern) String() string {
+	return p.src
+}
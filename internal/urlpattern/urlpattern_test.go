@@ -0,0 +1,84 @@
+package urlpattern
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, url string
+		rest         string
+		ok           bool
+	}{
+		{"example.com", "http://example.com/a", "/a", true},
+		{"example.com", "http://EXAMPLE.com/", "/", true},
+		{"example.com", "http://www.example.com/", "", false},
+		{"*.example.com", "https://cdn.example.com/x", "/x", true},
+		{"*.example.com", "https://example.com/x", "", false},
+		{"[ab].example.com", "https://b.example.com/", "/", true},
+		{"[ab].example.com", "https://c.example.com/", "", false},
+		{"https://example.com", "http://example.com/", "", false},
+		{"https://example.com", "https://example.com/", "/", true},
+
+		// ports, the default port of the scheme when the url has none
+		{"example.com:8443", "https://example.com:8443/", "/", true},
+		{"example.com:443", "https://example.com/", "/", true},
+		{"example.com:443", "http://example.com/", "", false},
+		{"[::1]:8080", "http://[::1]:8080/a", "/a", true},
+		{"[::1]", "http://[::1]:9000/a", "/a", true},
+
+		// path prefixes match at segment boundaries unless they end with a slash
+		{"example.com/static", "http://example.com/static", "", true},
+		{"example.com/static", "http://example.com/static/app.js", "/app.js", true},
+		{"example.com/static", "http://example.com/statical", "", false},
+		{"example.com/static/", "http://example.com/static/app.js", "app.js", true},
+		{"example.com/static/", "http://example.com/static", "", true},
+		{"example.com/st", "http://example.com/static", "", false},
+		{"example.com/", "http://example.com/a/b", "a/b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.url, func(t *testing.T) {
+			p, err := Parse(tt.pattern)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.pattern, err)
+			}
+			u, _ := url.Parse(tt.url)
+			rest, ok := p.Match(u)
+			if rest != tt.rest || ok != tt.ok {
+				t.Errorf("Match(%q) = %q, %v, want %q, %v", tt.url, rest, ok, tt.rest, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMatchesOrigin(t *testing.T) {
+	tests := []struct {
+		pattern, scheme, hostport string
+		want                      bool
+	}{
+		{"*.example.com", "https", "api.example.com:443", true},
+		{"example.com/", "https", "example.com:443", true},
+		{"example.com/api", "https", "example.com:443", false},
+		{"http://example.com", "https", "example.com:443", false},
+	}
+
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.pattern, err)
+		}
+		if got := p.MatchesOrigin(tt.scheme, tt.hostport); got != tt.want {
+			t.Errorf("%q MatchesOrigin(%s, %s) = %v, want %v", tt.pattern, tt.scheme, tt.hostport, got, tt.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, s := range []string{"", "ftp://example.com", "/static", ":8080", "[a-"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DecodeBody undoes the Content-Encoding of a captured body, bodies are captured as sent on the wire
+// gzip and deflate are supported, encodings are undone in reverse order of application
+func DecodeBody(header http.Header, body []byte) ([]byte, error) {
+	var codings []string
+	for _, v := range header.Values("Content-Encoding") {
+		for c := range strings.SplitSeq(v, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); len(c) > 0 && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+
+	for i := len(codings) - 1; i >= 0; i-- {
+		var (
+			r   io.Reader
+			err error
+		)
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// deflate is zlib wrapped, some servers send it raw
+			if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", codings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// EncodeBody applies the Content-Encoding of header to a decoded body, the inverse of DecodeBody
+func EncodeBody(header http.Header, body []byte) ([]byte, error) {
+	for _, v := range header.Values("Content-Encoding") {
+		for c := range strings.SplitSeq(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if len(c) == 0 || c == "identity" {
+				continue
+			}
+
+			var (
+				buf bytes.Buffer
+				w   io.WriteCloser
+			)
+			switch c {
+			case "gzip", "x-gzip":
+				w = gzip.NewWriter(&buf)
+			case "deflate":
+				w = zlib.NewWriter(&buf)
+			default:
+				return nil, fmt.Errorf("unsupported content encoding %q", c)
+			}
+			if _, err := w.Write(body); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			body = buf.Bytes()
+		}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"net/http"
+	"time"
+)
+
+// breakpoint phases
+const (
+	// the request is paused before it is forwarded upstream
+	BreakpointRequest = "request"
+
+	// the response is paused before it is returned to the client
+	BreakpointResponse = "response"
+)
+
+// breakpoint states, besides the resolution actions
+const (
+	// waiting for a client to resolve it
+	BreakpointPaused = "paused"
+
+	// the client conn of the flow went away while paused
+	BreakpointAbandoned = "abandoned"
+)
+
+// resolution actions
+const (
+	// continue the flow, with the edits applied
+	ResolveResume = "resume"
+
+	// close the client conn without a response
+	ResolveDrop = "drop"
+
+	// answer the client with the response of the resolution, without contacting upstream
+	ResolveRespond = "respond"
+)
+
+// Breakpoint is a flow paused by an intercept rule until a client resolves it
+type Breakpoint struct {
+	ID    string `json:"id"`
+	Phase string `json:"phase"`
+
+	// BreakpointPaused, BreakpointAbandoned or the resolution action
+	State string `json:"state"`
+
+	// the resolution was applied by the timeout policy
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// when the flow was paused and when the timeout policy resolves it
+	Time     time.Time `json:"time"`
+	Deadline time.Time `json:"deadline,omitempty"`
+
+	// the flow as paused, the response is only set in the response phase
+	Flow *PacketCaptureFlow `json:"flow"`
+}
+
+// Resolution resolves a breakpoint, empty fields keep the paused values
+type Resolution struct {
+	// ResolveResume by default
+	Action string `json:"action,omitempty"`
+
+	// request edits, in the request phase
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+
+	// response status, in the response phase or to respond
+	StatusCode int `json:"status_code,omitempty"`
+
+	// replaces the headers of the paused request or response, or the headers to respond with
+	Header http.Header `json:"header,omitempty"`
+
+	// replaces the body of the paused request or response, or the body to respond with
+	Body *string `json:"body,omitempty"`
+}
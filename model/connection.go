@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// connection lifecycle events
+const (
+	ConnOpened         = "opened"
+	ConnTLSEstablished = "tls_established"
+	ConnClosed         = "closed"
+)
+
+// connection sides
+const (
+	ClientSide = "client"
+	ServerSide = "server"
+)
+
+// ConnInfo identifies the client or server connection a flow was sent over
+type ConnInfo struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+	LocalAddr  string `json:"local_addr"`
+	TLS        bool   `json:"tls"`
+}
+
+// ConnectionEvent reports a connection lifecycle change
+// byte counts are seen from the proxy and only set when the connection is closed,
+// ClientConnID links a server conn to the client conn it was dialed for, pooled conns shared by the clients have none
+type ConnectionEvent struct {
+	Event        string    `json:"event"`
+	Side         string    `json:"side"`
+	ID           string    `json:"id"`
+	ClientConnID string    `json:"client_conn_id,omitempty"`
+	RemoteAddr   string    `json:"remote_addr"`
+	LocalAddr    string    `json:"local_addr"`
+	TLSVersion   string    `json:"tls_version,omitempty"`
+	ServerName   string    `json:"server_name,omitempty"`
+	ALPN         string    `json:"alpn,omitempty"`
+	BytesRead    int64     `json:"bytes_read,omitempty"`
+	BytesWritten int64     `json:"bytes_written,omitempty"`
+	Time         time.Time `json:"time"`
+}
@@ -0,0 +1,123 @@
+package model
+
+import "time"
+
+// EventVersion is the version of the event schema
+// it is bumped on incompatible changes, new event types and fields are added without a bump
+const EventVersion = 1
+
+// event types
+const (
+	// the request was received and is about to be forwarded
+	EventRequestStarted = "request_started"
+
+	// the response headers are about to be sent to the client
+	EventResponseHeaders = "response_headers"
+
+	// the response body was sent to the client, the flow is complete
+	EventResponseComplete = "response_complete"
+
+	// the flow failed
+	EventFlowError = "flow_error"
+
+	// a websocket frame was relayed
+	EventWebSocketMessage = "websocket_message"
+
+	// a connection lifecycle change
+	EventConnection = "connection_event"
+
+	// a message about the capture stream itself, e.g. dropped events
+	EventNotice = "notice"
+
+	// a flow was paused by an intercept rule or its breakpoint was resolved
+	EventBreakpoint = "breakpoint"
+)
+
+// EventTypes lists every event type
+var EventTypes = []string{
+	EventRequestStarted,
+	EventResponseHeaders,
+	EventResponseComplete,
+	EventFlowError,
+	EventWebSocketMessage,
+	EventConnection,
+	EventNotice,
+	EventBreakpoint,
+}
+
+// Event is the envelope of everything published on the capture stream
+// the payload field set depends on the type
+type Event struct {
+	Version    int                `json:"version"`
+	Type       string             `json:"type"`
+	Time       time.Time          `json:"time"`
+	Flow       *PacketCaptureFlow `json:"flow,omitempty"`
+	Connection *ConnectionEvent   `json:"connection,omitempty"`
+	WebSocket  *WebSocketMessage  `json:"websocket,omitempty"`
+	Notice     *Notice            `json:"notice,omitempty"`
+	Breakpoint *Breakpoint        `json:"breakpoint,omitempty"`
+}
+
+// WebSocketMessage is a websocket frame relayed over an upgraded flow
+type WebSocketMessage struct {
+	FlowID     string `json:"flow_id"`
+	FromClient bool   `json:"from_client"`
+	Opcode     string `json:"opcode"`
+	Fin        bool   `json:"fin"`
+
+	// unmasked payload, truncated to the capture limit
+	Payload []byte `json:"payload"`
+
+	// payload length on the wire
+	Length int64 `json:"length"`
+}
+
+// Notice tells a capture client about its own stream, e.g. that it fell behind and events were dropped
+type Notice struct {
+	Notice  string `json:"notice"`
+	Dropped int64  `json:"dropped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newEvent(typ string) *Event {
+	return &Event{
+		Version: EventVersion,
+		Type:    typ,
+		Time:    time.Now(),
+	}
+}
+
+// NewFlowEvent wraps a flow snapshot
+func NewFlowEvent(typ string, flow *PacketCaptureFlow) *Event {
+	event := newEvent(typ)
+	event.Flow = flow
+	return event
+}
+
+// NewConnectionEvent wraps a connection lifecycle change
+func NewConnectionEvent(conn *ConnectionEvent) *Event {
+	event := newEvent(EventConnection)
+	event.Connection = conn
+	return event
+}
+
+// NewWebSocketEvent wraps a relayed websocket frame
+func NewWebSocketEvent(msg *WebSocketMessage) *Event {
+	event := newEvent(EventWebSocketMessage)
+	event.WebSocket = msg
+	return event
+}
+
+// NewNoticeEvent wraps a notice
+func NewNoticeEvent(notice *Notice) *Event {
+	event := newEvent(EventNotice)
+	event.Notice = notice
+	return event
+}
+
+// NewBreakpointEvent wraps a breakpoint
+func NewBreakpointEvent(breakpoint *Breakpoint) *Event {
+	event := newEvent(EventBreakpoint)
+	event.Breakpoint = breakpoint
+	return event
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+type PacketCaptureFlow struct {
+	ID         string    `json:"id"`
+	Seq        uint64    `json:"seq"`
+	ClientConn *ConnInfo `json:"client_conn"`
+	ServerConn *ConnInfo `json:"server_conn"`
+	Request    *Request  `json:"request"`
+	Response   *Response `json:"response"`
+	Timing     *Timing   `json:"timing"`
+	Error      string    `json:"error,omitempty"`
+
+	// id of the flow this one replayed
+	ReplayOf string `json:"replay_of,omitempty"`
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+type Response struct {
+	Proto      string         `json:"proto"`
+	StatusCode int            `json:"status_code"`
+	StatusText string         `json:"status_text"`
+	Header     http.Header    `json:"header"`
+	Body       []byte         `json:"body"`
+	Cookies    []*http.Cookie `json:"cookies"`
+}
+
+// NewPacketCaptureFlow starts a flow for req, the request body is recorded once it was sent
+// the request and response of a flow are replaced rather than modified so published snapshots stay intact
+func NewPacketCaptureFlow(req *http.Request, clientConn *ConnInfo) *PacketCaptureFlow {
+	return &PacketCaptureFlow{
+		ID:         uuid.NewString(),
+		ClientConn: clientConn,
+		Request:    NewRequest(req, nil),
+	}
+}
+
+// Snapshot returns a copy of the flow that is safe to publish while the flow progresses
+func (f *PacketCaptureFlow) Snapshot() *PacketCaptureFlow {
+	snapshot := *f
+	return &snapshot
+}
+
+func NewRequest(req *http.Request, body []byte) *Request {
+	return &Request{
+		Method: req.Method,
+		Url:    req.URL.String(),
+		Header: req.Header,
+		Body:   body,
+	}
+}
+
+func NewResponse(resp *http.Response, body []byte) *Response {
+	return &Response{
+		Proto:      resp.Proto,
+		StatusCode: resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+		Header:     resp.Header,
+		Body:       body,
+		Cookies:    resp.Cookies(),
+	}
+}
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// Timing is the latency breakdown of a flow
+// connection level phases are zero when the flow reused an existing connection
+type Timing struct {
+	// client connection accepted by the proxy
+	ClientConnect time.Time `json:"client_connect"`
+
+	// CONNECT request received, zero for plain http
+	ConnectReceived time.Time `json:"connect_received,omitzero"`
+
+	// upstream dns lookup
+	DNS time.Duration `json:"dns"`
+
+	// upstream tcp connect
+	TCPConnect time.Duration `json:"tcp_connect"`
+
+	// upstream tls handshake
+	UpstreamTLS time.Duration `json:"upstream_tls"`
+
+	// client tls handshake, excluding the upstream handshake it waits for
+	ClientTLS time.Duration `json:"client_tls"`
+
+	// request received from the client
+	RequestStart time.Time `json:"request_start"`
+
+	// request fully written upstream
+	RequestSent time.Time `json:"request_sent,omitzero"`
+
+	// first response byte received from upstream
+	FirstResponseByte time.Time `json:"first_response_byte,omitzero"`
+
+	// response body fully copied to the client
+	ResponseComplete time.Time `json:"response_complete,omitzero"`
+}
+
+// Reused clears the connection level phases for a flow sent over an already established connection
+func (t *Timing) Reused() {
+	t.DNS, t.TCPConnect, t.UpstreamTLS, t.ClientTLS = 0, 0, 0, 0
+}
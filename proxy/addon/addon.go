@@ -0,0 +1,96 @@
+package addon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrDrop is returned by a hook to close the client conn without answering it
+	ErrDrop = errors.New("dropped")
+
+	// ErrReset is returned by a hook to reset the client conn without answering it
+	ErrReset = errors.New("reset")
+)
+
+// Addon intercepts the requests and responses passing through the proxy
+type Addon interface {
+	// Request is called before the request is forwarded upstream.
+	// The request may be modified in place, returning a non-nil response answers the client without contacting upstream.
+	Request(r *http.Request) (*http.Response, error)
+
+	// Response is called before the response is returned to the client.
+	// The returned response replaces resp.
+	Response(r *http.Request, resp *http.Response) (*http.Response, error)
+}
+
+// Redirector is implemented by addons sending every request for a destination elsewhere,
+// to another origin or to the addon itself answering it,
+// the proxy does not dial such destinations when it intercepts their tunnels, as no request will reach them
+type Redirector interface {
+	// Redirects reports whether every https request to hostport is redirected
+	Redirects(hostport string) bool
+}
+
+// Base is a no-op Addon meant to be embedded by addons implementing a single hook
+type Base struct{}
+
+func (Base) Request(r *http.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (Base) Response(r *http.Request, resp *http.Response) (*http.Response, error) {
+	return resp, nil
+}
+
+// Chain runs addons in order
+type Chain []Addon
+
+// Request runs the request hooks until one answers the request or fails
+func (c Chain) Request(r *http.Request) (*http.Response, error) {
+	for _, a := range c {
+		resp, err := a.Request(r)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Response runs the response hooks, each one receiving the response returned by the previous
+func (c Chain) Response(r *http.Request, resp *http.Response) (*http.Response, error) {
+	var err error
+	for _, a := range c {
+		if resp, err = a.Response(r, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// Redirects reports whether one of the addons redirects every https request to hostport
+func (c Chain) Redirects(hostport string) bool {
+	for _, a := range c {
+		if r, ok := a.(Redirector); ok && r.Redirects(hostport) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type flowIDKey struct{}
+
+// WithFlowID returns a context carrying the id of the flow of the request
+func WithFlowID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, flowIDKey{}, id)
+}
+
+// FlowID returns the id of the flow r belongs to, so hooks can refer to the captured flow
+func FlowID(r *http.Request) string {
+	id, _ := r.Context().Value(flowIDKey{}).(string)
+	return id
+}
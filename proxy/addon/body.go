@@ -0,0 +1,47 @@
+package addon
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ReadBody reads *body up to limit bytes, a negative limit reads it whole,
+// and replaces it with a reader over what was read, so the body can still be forwarded or captured
+// ok is false when the body is larger than limit, then the reader goes on with the rest of it
+func ReadBody(body *io.ReadCloser, limit int64) (data []byte, ok bool, err error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, true, nil
+	}
+
+	r := io.Reader(*body)
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	data, err = io.ReadAll(r)
+	if err != nil {
+		(*body).Close()
+		return nil, false, err
+	}
+	if limit >= 0 && int64(len(data)) > limit {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), *body), *body}
+		return nil, false, nil
+	}
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+
+	return data, true, nil
+}
+
+// MaxBodySize is the largest body addons buffer, larger ones are left streaming
+const MaxBodySize = 16 << 20
+
+// Streaming reports whether resp never completes, as upgrades and event streams do,
+// so its body cannot be buffered
+func Streaming(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
@@ -0,0 +1,126 @@
+package block
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/internal/urlpattern"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/sirupsen/logrus"
+)
+
+// rule actions
+const (
+	// answer with the configured status, headers and body
+	ActionRespond = "respond"
+
+	// close the client conn without a response
+	ActionClose = "close"
+
+	// reset the client conn without a response
+	ActionReset = "reset"
+)
+
+// Rule blocks the requests matching URL and Filter
+type Rule struct {
+	// [scheme://]host[:port][/path], the host is a glob and the path a prefix, e.g. *.analytics.example.com
+	URL string `json:"url"`
+
+	// narrows the matching requests, matched without the request body, empty matches every request of URL
+	Filter *filter.Expr `json:"filter,omitempty"`
+
+	// ActionRespond by default
+	Action string `json:"action,omitempty"`
+
+	// answer of ActionRespond, 403 Forbidden by default
+	Status int               `json:"status,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+}
+
+// Block answers, closes or resets the requests matching its rules without contacting upstream
+type Block struct {
+	addon.Base
+
+	rules  []*rule
+	logger logrus.FieldLogger
+}
+
+type rule struct {
+	Rule
+
+	pattern *urlpattern.Pattern
+}
+
+func New(rules []Rule, logger logrus.FieldLogger) (*Block, error) {
+	b := &Block{logger: logger}
+	for _, r := range rules {
+		pattern, err := urlpattern.Parse(r.URL)
+		if err != nil {
+			return nil, err
+		}
+		switch r.Action {
+		case "":
+			r.Action = ActionRespond
+		case ActionRespond, ActionClose, ActionReset:
+		default:
+			return nil, fmt.Errorf("block %s: unknown action %q, want %s, %s or %s", r.URL, r.Action, ActionRespond, ActionClose, ActionReset)
+		}
+		if r.Status == 0 {
+			r.Status = http.StatusForbidden
+		} else if r.Status < 100 || r.Status > 999 {
+			return nil, fmt.Errorf("block %s: invalid status %d", r.URL, r.Status)
+		}
+		b.rules = append(b.rules, &rule{Rule: r, pattern: pattern})
+	}
+
+	return b, nil
+}
+
+// Redirects reports whether a rule blocks every https request to hostport
+func (b *Block) Redirects(hostport string) bool {
+	for _, rule := range b.rules {
+		if rule.Filter.Empty() && rule.pattern.MatchesOrigin("https", hostport) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Request blocks the request by the first matching rule
+func (b *Block) Request(r *http.Request) (*http.Response, error) {
+	for _, rule := range b.rules {
+		if _, ok := rule.pattern.Match(r.URL); !ok {
+			continue
+		}
+		if !rule.Filter.Empty() && !rule.Filter.Match(&model.PacketCaptureFlow{ID: addon.FlowID(r), Request: model.NewRequest(r, nil)}) {
+			continue
+		}
+		b.logger.Debugf("block %s %s: %s", r.Method, r.URL, rule.Action)
+
+		switch rule.Action {
+		case ActionClose:
+			return nil, fmt.Errorf("blocked: %w", addon.ErrDrop)
+		case ActionReset:
+			return nil, fmt.Errorf("blocked: %w", addon.ErrReset)
+		}
+		return rule.respond(r), nil
+	}
+
+	return nil, nil
+}
+
+func (rule *rule) respond(r *http.Request) *http.Response {
+	header := make(http.Header)
+	for name, value := range rule.Header {
+		header.Set(name, value)
+	}
+	if len(header.Get("Content-Type")) == 0 && len(rule.Body) > 0 {
+		header.Set("Content-Type", http.DetectContentType([]byte(rule.Body)))
+	}
+
+	return addon.NewResponse(r, rule.Status, header, []byte(rule.Body))
+}
@@ -0,0 +1,84 @@
+package capture
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Access guards the capture endpoints
+// captured flows carry credentials, so clients must present the token and browsers must come from an allowed origin
+type Access struct {
+	// required bearer token, empty disables the check
+	Token string
+
+	// origins browsers may connect from, e.g. http://localhost:3000, "*" allows any
+	// the origin of the capture endpoint itself is always allowed
+	Origins []string
+}
+
+// NewToken returns a random capture token
+func NewToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Wrap serves h to requests that pass the checks
+func (a *Access) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.checkOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if !a.checkToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mitmfoxy"`)
+			http.Error(w, "invalid capture token", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkToken accepts the token from the Authorization header,
+// or from the token query parameter since browsers can't set headers on websockets
+func (a *Access) checkToken(r *http.Request) bool {
+	if len(a.Token) == 0 {
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// checkOrigin accepts non browser clients, which send no origin, same origin requests and allowed origins
+func (a *Access) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if slices.Contains(a.Origins, "*") {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return slices.ContainsFunc(a.Origins, func(allowed string) bool {
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), u.Scheme+"://"+u.Host)
+	})
+}
@@ -0,0 +1,259 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/sirupsen/logrus"
+)
+
+// dump detail levels
+const (
+	// one line per flow
+	DumpLine = 1 + iota
+
+	// also the request and response headers
+	DumpHeaders
+
+	// also the bodies, truncated to DumpBodyLimit
+	DumpBodies
+
+	// also the full bodies
+	DumpFullBodies
+)
+
+// DumpBodyLimit is the number of body bytes printed at DumpBodies
+const DumpBodyLimit = 1024
+
+// ansi colors
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// DumpConfig controls what a DumpSink prints
+type DumpConfig struct {
+	// DumpLine by default
+	Detail int
+
+	// colorize with ansi escapes
+	Color bool
+
+	// flows not matching are not printed, nil prints every flow
+	Filter *filter.Expr
+}
+
+// DumpSink prints completed and failed flows for humans, e.g. to a terminal
+type DumpSink struct {
+	w      io.Writer
+	conf   DumpConfig
+	logger logrus.FieldLogger
+	queue  *sinkQueue
+}
+
+func (s *DumpSink) Publish(event *model.Event) {
+	if event.Flow != nil && !s.conf.Filter.Match(event.Flow) {
+		return
+	}
+
+	s.queue.push(event)
+}
+
+// Close prints the queued flows
+func (s *DumpSink) Close() error {
+	s.queue.close()
+	return nil
+}
+
+func (s *DumpSink) run() {
+	defer close(s.queue.stopped)
+
+	for {
+		select {
+		case event := <-s.queue.events:
+			s.write(s.queue.take(event))
+		case <-s.queue.closing:
+			s.write(s.queue.take(nil))
+			return
+		}
+	}
+}
+
+func (s *DumpSink) write(events []*model.Event) {
+	var b bytes.Buffer
+	for _, event := range events {
+		if event.Notice != nil {
+			fmt.Fprintf(&b, "%s\n", s.paint(colorYellow, fmt.Sprintf("... %d flows not printed, the terminal fell behind", event.Notice.Dropped)))
+			continue
+		}
+		if event.Flow != nil {
+			s.format(&b, event.Flow)
+		}
+	}
+
+	if _, err := s.w.Write(b.Bytes()); err != nil {
+		s.logger.Errorf("dump sink: %v", err)
+	}
+}
+
+// Print prints flow if it matches the filter, e.g. for flows read from a capture file
+func (s *DumpSink) Print(flow *model.PacketCaptureFlow) error {
+	if !s.conf.Filter.Match(flow) {
+		return nil
+	}
+
+	var b bytes.Buffer
+	s.format(&b, flow)
+	_, err := s.w.Write(b.Bytes())
+	return err
+}
+
+// format writes the line of flow and its details
+func (s *DumpSink) format(b *bytes.Buffer, flow *model.PacketCaptureFlow) {
+	if flow.Request == nil {
+		return
+	}
+
+	var start time.Time
+	if flow.Timing != nil {
+		start = flow.Timing.RequestStart
+	}
+	if !start.IsZero() {
+		fmt.Fprintf(b, "%s ", s.paint(colorDim, start.Local().Format("15:04:05.000")))
+	}
+	if flow.ClientConn != nil {
+		fmt.Fprintf(b, "%s ", flow.ClientConn.RemoteAddr)
+	}
+	if len(flow.ReplayOf) > 0 {
+		fmt.Fprintf(b, "%s ", s.paint(colorCyan, "[replay]"))
+	}
+	fmt.Fprintf(b, "%s %s", s.paint(colorBold, flow.Request.Method), flow.Request.Url)
+
+	switch {
+	case len(flow.Error) > 0:
+		fmt.Fprintf(b, " %s %s", s.paint(colorDim, "<<"), s.paint(colorRed, "error: "+flow.Error))
+	case flow.Response != nil:
+		fmt.Fprintf(b, " %s %s %s", s.paint(colorDim, "<<"), s.paint(statusColor(flow.Response.StatusCode), fmt.Sprintf("%d %s", flow.Response.StatusCode, flow.Response.StatusText)), formatSize(len(flow.Response.Body)))
+	}
+	if t := flow.Timing; t != nil && !t.RequestStart.IsZero() && !t.ResponseComplete.IsZero() {
+		fmt.Fprintf(b, " %s", t.ResponseComplete.Sub(t.RequestStart).Round(100*time.Microsecond))
+	}
+	b.WriteByte('\n')
+
+	if s.conf.Detail < DumpHeaders {
+		return
+	}
+	s.formatHeader(b, flow.Request.Header)
+	if s.formatBody(b, flow.Request.Header, flow.Request.Body) {
+		b.WriteByte('\n')
+	}
+	if flow.Response != nil {
+		fmt.Fprintf(b, "    %s %s\n", s.paint(colorDim, "<<"), s.paint(statusColor(flow.Response.StatusCode), fmt.Sprintf("%s %d %s", flow.Response.Proto, flow.Response.StatusCode, flow.Response.StatusText)))
+		s.formatHeader(b, flow.Response.Header)
+		s.formatBody(b, flow.Response.Header, flow.Response.Body)
+	}
+	b.WriteByte('\n')
+}
+
+func (s *DumpSink) formatHeader(b *bytes.Buffer, header http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, value := range header[name] {
+			fmt.Fprintf(b, "    %s %s\n", s.paint(colorCyan, name+":"), value)
+		}
+	}
+}
+
+// formatBody writes the decoded body after a blank line, binary bodies are summarized
+// it reports whether anything was written
+func (s *DumpSink) formatBody(b *bytes.Buffer, header http.Header, body []byte) bool {
+	if s.conf.Detail < DumpBodies || len(body) == 0 {
+		return false
+	}
+
+	if decoded, err := model.DecodeBody(header, body); err == nil {
+		body = decoded
+	}
+	b.WriteByte('\n')
+	if !utf8.Valid(body) {
+		fmt.Fprintf(b, "    %s\n", s.paint(colorDim, fmt.Sprintf("[%s binary]", formatSize(len(body)))))
+		return true
+	}
+
+	truncated := 0
+	if s.conf.Detail < DumpFullBodies && len(body) > DumpBodyLimit {
+		truncated = len(body) - DumpBodyLimit
+		body = body[:DumpBodyLimit]
+	}
+
+	for line := range strings.Lines(string(body)) {
+		fmt.Fprintf(b, "    %s\n", strings.TrimRight(line, "\r\n"))
+	}
+	if truncated > 0 {
+		fmt.Fprintf(b, "    %s\n", s.paint(colorDim, fmt.Sprintf("[%s more]", formatSize(truncated))))
+	}
+
+	return true
+}
+
+func (s *DumpSink) paint(color, text string) string {
+	if !s.conf.Color {
+		return text
+	}
+
+	return color + text + colorReset
+}
+
+func statusColor(code int) string {
+	switch {
+	case code >= 500:
+		return colorRed
+	case code >= 400:
+		return colorYellow
+	case code >= 300:
+		return colorCyan
+	default:
+		return colorGreen
+	}
+}
+
+// formatSize formats n bytes with a binary unit
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fk", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%db", n)
+	}
+}
+
+// NewDumpSink prints the completed and failed flows to w
+func NewDumpSink(w io.Writer, conf *DumpConfig, logger logrus.FieldLogger) *DumpSink {
+	s := &DumpSink{
+		w:      w,
+		conf:   *conf,
+		logger: logger,
+		queue:  newSinkQueue(nil),
+	}
+	if s.conf.Detail == 0 {
+		s.conf.Detail = DumpLine
+	}
+	go s.run()
+
+	return s
+}
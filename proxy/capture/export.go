@@ -0,0 +1,45 @@
+package capture
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/har"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// HARHandler downloads the stored flows as HAR
+// the flows are selected with the filter and backlog query parameters of the capture streams, all by default
+func HARHandler(store *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		subscription, backlog, err := parseStreamQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		flows := store.Flows()
+		if backlog != nil {
+			if flows, _, err = store.Backlog(backlog); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		flows = slices.DeleteFunc(flows, func(flow *model.PacketCaptureFlow) bool {
+			return !subscription.Accepts(StoredFlowEvent(flow))
+		})
+
+		filename := fmt.Sprintf("mitmfoxy-%s.har", time.Now().Format("20060102T150405"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		har.Write(w, flows)
+	})
+}
@@ -0,0 +1,269 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// DefaultQueueSize is the number of messages buffered per subscriber
+const DefaultQueueSize = 256
+
+// Hub fans capture events out to subscribers
+// every subscriber has a bounded queue so a slow one never stalls publishing
+// flows are kept in a store so late subscribers can request a backlog
+type Hub struct {
+	mu        sync.RWMutex
+	subs      map[*Subscriber]struct{}
+	closed    bool
+	queueSize int
+	store     *Store
+}
+
+func NewHub(queueSize int, store *Store) *Hub {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	return &Hub{
+		subs:      make(map[*Subscriber]struct{}),
+		queueSize: queueSize,
+		store:     store,
+	}
+}
+
+// Store returns the flows kept by the hub
+func (h *Hub) Store() *Store {
+	return h.store
+}
+
+// Subscribe registers a new subscriber, which is already done when the hub is closed
+func (h *Hub) Subscribe() *Subscriber {
+	s := &Subscriber{
+		queue: make(chan *model.Event, h.queueSize),
+		done:  make(chan struct{}),
+		kick:  make(chan struct{}, 1),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		s.close()
+		return s
+	}
+	h.subs[s] = struct{}{}
+
+	return s
+}
+
+// Unsubscribe removes the subscriber and marks it done
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+
+	s.close()
+}
+
+// Publish queues the event to every subscriber accepting it, dropping it for subscribers whose queue is full
+// completed and failed flows are stored first
+func (h *Hub) Publish(event *model.Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// stored under the hub lock so a backlog never misses or repeats a broadcast flow
+	if event.Type == model.EventResponseComplete || event.Type == model.EventFlowError {
+		h.store.Add(event.Flow)
+	}
+
+	for s := range h.subs {
+		if s.Subscription().Accepts(event) {
+			s.send(event)
+		}
+	}
+}
+
+// Load stores flows captured elsewhere, e.g. imported from a HAR file, and publishes them as completed flows
+func (h *Hub) Load(flows []*model.PacketCaptureFlow) {
+	for _, flow := range flows {
+		h.Publish(StoredFlowEvent(flow))
+	}
+}
+
+// Replay subscribes s and queues the stored flows requested by its backlog ahead of live events
+// events queued but not yet sent are discarded, so flows already received may be repeated and are identified by seq
+func (h *Hub) Replay(s *Subscriber, subscription *Subscription, backlog *Backlog) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	flows, missed, err := h.store.Backlog(backlog)
+	if err != nil {
+		return err
+	}
+
+	s.Subscribe(subscription)
+	s.drain()
+
+	replay := make([]*model.Event, 0, len(flows)+2)
+	replay = append(replay, SubscribedNotice())
+	if missed > 0 {
+		replay = append(replay, MissedNotice(missed))
+	}
+	for _, flow := range flows {
+		if event := StoredFlowEvent(flow); subscription.Accepts(event) {
+			replay = append(replay, event)
+		}
+	}
+	s.setBacklog(replay)
+
+	return nil
+}
+
+// StoredFlowEvent wraps a stored flow in the event that completed it
+func StoredFlowEvent(flow *model.PacketCaptureFlow) *model.Event {
+	if len(flow.Error) > 0 {
+		return model.NewFlowEvent(model.EventFlowError, flow)
+	}
+
+	return model.NewFlowEvent(model.EventResponseComplete, flow)
+}
+
+// Close marks every subscriber done and rejects new ones
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for s := range h.subs {
+		s.close()
+		delete(h.subs, s)
+	}
+}
+
+// Subscriber is a bounded queue of the events published to a hub
+type Subscriber struct {
+	queue        chan *model.Event
+	done         chan struct{}
+	dropped      atomic.Int64
+	closeOnce    sync.Once
+	subscription atomic.Pointer[Subscription]
+
+	// replayed events sent before the queue
+	mu      sync.Mutex
+	backlog []*model.Event
+	kick    chan struct{}
+}
+
+// Backlog signals that replayed events are waiting
+func (s *Subscriber) Backlog() <-chan struct{} {
+	return s.kick
+}
+
+// TakeBacklog returns the replayed events not sent yet, they must be sent before the next queued event
+func (s *Subscriber) TakeBacklog() []*model.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backlog := s.backlog
+	s.backlog = nil
+	return backlog
+}
+
+func (s *Subscriber) setBacklog(backlog []*model.Event) {
+	s.mu.Lock()
+	s.backlog = backlog
+	s.mu.Unlock()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// drain discards the queued events
+func (s *Subscriber) drain() {
+	for {
+		select {
+		case <-s.queue:
+		default:
+			return
+		}
+	}
+}
+
+// Subscribe replaces the subscription selecting the events queued to the subscriber
+func (s *Subscriber) Subscribe(subscription *Subscription) {
+	s.subscription.Store(subscription)
+}
+
+// Subscription returns the current subscription, nil receives everything
+func (s *Subscriber) Subscription() *Subscription {
+	return s.subscription.Load()
+}
+
+// Notify queues a notice regardless of the subscription
+func (s *Subscriber) Notify(notice *model.Event) {
+	s.send(notice)
+}
+
+// Events returns the queued events
+func (s *Subscriber) Events() <-chan *model.Event {
+	return s.queue
+}
+
+// Done is closed once the subscriber is unsubscribed or the hub is closed
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// TakeDropped returns the number of events dropped since the last call
+func (s *Subscriber) TakeDropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *Subscriber) send(event *model.Event) {
+	select {
+	case s.queue <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Subscriber) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// DroppedNotice is sent before the next event once a subscriber fell behind and events were dropped
+func DroppedNotice(dropped int64) *model.Event {
+	return model.NewNoticeEvent(&model.Notice{
+		Notice:  "dropped",
+		Dropped: dropped,
+	})
+}
+
+// SubscribedNotice acknowledges a subscription
+func SubscribedNotice() *model.Event {
+	return model.NewNoticeEvent(&model.Notice{
+		Notice: "subscribed",
+	})
+}
+
+// MissedNotice tells a resuming subscriber that flows after its cursor were evicted from the store
+func MissedNotice(missed uint64) *model.Event {
+	return model.NewNoticeEvent(&model.Notice{
+		Notice:  "missed",
+		Dropped: int64(missed),
+	})
+}
+
+// ErrorNotice reports an invalid client message
+func ErrorNotice(err error) *model.Event {
+	return model.NewNoticeEvent(&model.Notice{
+		Notice: "error",
+		Error:  err.Error(),
+	})
+}
@@ -0,0 +1,70 @@
+package capture
+
+import (
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// testFlow is a completed GET of url
+func testFlow(id, url string) *model.PacketCaptureFlow {
+	return &model.PacketCaptureFlow{
+		ID:       id,
+		Request:  &model.Request{Method: "GET", Url: url},
+		Response: &model.Response{StatusCode: 200},
+	}
+}
+
+func TestHubDropsForSlowSubscriber(t *testing.T) {
+	hub := NewHub(2, NewStore(10))
+	slow, fast := hub.Subscribe(), hub.Subscribe()
+
+	for i := range 5 {
+		hub.Publish(model.NewFlowEvent(model.EventRequestStarted, testFlow(string(rune('a'+i)), "http://example.com/")))
+		<-fast.Events()
+	}
+
+	if n := len(slow.Events()); n != 2 {
+		t.Errorf("slow subscriber queued %d events, want 2", n)
+	}
+	if dropped := slow.TakeDropped(); dropped != 3 {
+		t.Errorf("slow subscriber dropped %d events, want 3", dropped)
+	}
+	if dropped := slow.TakeDropped(); dropped != 0 {
+		t.Errorf("TakeDropped() = %d after taking, want 0", dropped)
+	}
+	if dropped := fast.TakeDropped(); dropped != 0 {
+		t.Errorf("fast subscriber dropped %d events, want 0", dropped)
+	}
+}
+
+func TestHubPublishesAcceptedEvents(t *testing.T) {
+	hub := NewHub(0, NewStore(10))
+	sub := hub.Subscribe()
+	sub.Subscribe(&Subscription{Expr: filter.MustParse("host:a.example.com")})
+
+	hub.Publish(model.NewFlowEvent(model.EventRequestStarted, testFlow("a", "http://a.example.com/")))
+	hub.Publish(model.NewFlowEvent(model.EventRequestStarted, testFlow("b", "http://b.example.com/")))
+
+	if n := len(sub.Events()); n != 1 {
+		t.Fatalf("queued %d events, want 1", n)
+	}
+	if event := <-sub.Events(); event.Flow.ID != "a" {
+		t.Errorf("queued flow %q, want a", event.Flow.ID)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(0, NewStore(10))
+	before := hub.Subscribe()
+	hub.Close()
+
+	for name, sub := range map[string]*Subscriber{"before": before, "after": hub.Subscribe()} {
+		select {
+		case <-sub.Done():
+		default:
+			t.Errorf("subscriber subscribed %s the close is not done", name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/Twacqwq/mitmfoxy/har"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// max size of an imported capture
+const maxImportSize = 512 << 20
+
+// ReadFlows reads the flows of a HAR log or of jsonl capture events as written by the sinks, gzipped or not
+func ReadFlows(r io.Reader) ([]*model.PacketCaptureFlow, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(br, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportSize {
+		return nil, fmt.Errorf("capture larger than %d bytes", maxImportSize)
+	}
+
+	// a har log is a single object with a log, capture events are one object per line
+	var probe struct {
+		Log json.RawMessage `json:"log"`
+	}
+	if json.Unmarshal(data, &probe) == nil && probe.Log != nil {
+		h, err := har.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return h.Flows()
+	}
+
+	return readJSONL(data)
+}
+
+// ReadFlowsFile reads the flows of the named HAR or jsonl capture file
+func ReadFlowsFile(name string) ([]*model.PacketCaptureFlow, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	flows, err := ReadFlows(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return flows, nil
+}
+
+// readJSONL collects the completed flows of capture events in the order they first completed
+// a flow published more than once keeps its latest state
+func readJSONL(data []byte) ([]*model.PacketCaptureFlow, error) {
+	var flows []*model.PacketCaptureFlow
+	index := make(map[string]int)
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var event model.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if event.Flow == nil || (event.Type != model.EventResponseComplete && event.Type != model.EventFlowError) {
+			continue
+		}
+
+		if j, ok := index[event.Flow.ID]; ok {
+			flows[j] = event.Flow
+			continue
+		}
+		index[event.Flow.ID] = len(flows)
+		flows = append(flows, event.Flow)
+	}
+
+	return flows, nil
+}
+
+// ImportHandler loads a posted HAR log or jsonl capture into the hub
+func ImportHandler(hub *Hub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flows, err := ReadFlows(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hub.Load(flows)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"loaded": len(flows)})
+	})
+}
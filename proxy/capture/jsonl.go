@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/sirupsen/logrus"
+)
+
+// JSONLSink writes events as json lines, e.g. to stdout or a RotatingFile
+// every event is written with a single Write so a rotating writer never splits a line
+type JSONLSink struct {
+	w      io.Writer
+	logger logrus.FieldLogger
+	queue  *sinkQueue
+}
+
+func (s *JSONLSink) Publish(event *model.Event) {
+	s.queue.push(event)
+}
+
+// Close writes the queued events, then closes the writer if it is an io.Closer
+func (s *JSONLSink) Close() error {
+	s.queue.close()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (s *JSONLSink) run() {
+	defer close(s.queue.stopped)
+
+	for {
+		select {
+		case event := <-s.queue.events:
+			s.write(s.queue.take(event))
+		case <-s.queue.closing:
+			s.write(s.queue.take(nil))
+			return
+		}
+	}
+}
+
+func (s *JSONLSink) write(events []*model.Event) {
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			s.logger.Errorf("jsonl sink: %v", err)
+			continue
+		}
+		if _, err := s.w.Write(append(line, '\n')); err != nil {
+			s.logger.Errorf("jsonl sink: %v", err)
+		}
+	}
+}
+
+// NewJSONLSink writes the events of types to w, DefaultSinkEvents when empty
+// w is closed with the sink if it is an io.Closer
+func NewJSONLSink(w io.Writer, types []string, logger logrus.FieldLogger) *JSONLSink {
+	s := &JSONLSink{
+		w:      w,
+		logger: logger,
+		queue:  newSinkQueue(types),
+	}
+	go s.run()
+
+	return s
+}
@@ -0,0 +1,164 @@
+package capture
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a file that is moved aside once it grows too large or too old
+// rotated files are named after the rotation time, e.g. flows-20060102T150405.000.jsonl, and optionally gzipped
+type RotatingFile struct {
+	path string
+
+	// rotate before a write would grow the file past maxSize bytes, zero disables
+	maxSize int64
+
+	// rotate on the first write after the file is maxAge old, zero disables
+	maxAge time.Duration
+
+	// gzip rotated files
+	compress bool
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, compress bool) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	r := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	// a failed rotation keeps writing to whatever file is open and is reported with the write
+	var rotateErr error
+	tooLarge := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.maxAge > 0 && time.Since(r.opened) >= r.maxAge
+	if tooLarge || tooOld {
+		if rotateErr = r.rotate(); r.f == nil {
+			return 0, rotateErr
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return n, rotateErr
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+
+	return err
+}
+
+// open opens the file for appending, an existing file counts from its modification time
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+// rotate moves the file aside and opens a new one, r.f is nil only if no file could be opened
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	ext := filepath.Ext(r.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().Format("20060102T150405.000"), ext)
+	renameErr := os.Rename(r.path, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	if r.compress {
+		if err := gzipFile(rotated); err != nil {
+			return fmt.Errorf("gzip %s: %w", rotated, err)
+		}
+	}
+
+	return nil
+}
+
+// gzipFile replaces name with name.gz
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
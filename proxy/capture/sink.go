@@ -0,0 +1,177 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// DefaultSinkEvents are the event types recorded by the built-in sinks unless configured otherwise
+var DefaultSinkEvents = []string{model.EventResponseComplete, model.EventFlowError}
+
+// Sink receives the capture events
+// events of a flow are published in order from the goroutine serving it, so Publish must not block
+// sinks holding resources implement io.Closer and are closed once the proxy stopped
+type Sink interface {
+	// Publish is called with every capture event
+	Publish(event *model.Event)
+}
+
+// Sinks publishes to every sink in order
+type Sinks []Sink
+
+func (s Sinks) Publish(event *model.Event) {
+	for _, sink := range s {
+		sink.Publish(event)
+	}
+}
+
+// Close flushes and closes the sinks that implement io.Closer
+func (s Sinks) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown is like Close, the sinks implementing Shutdowner give up flushing once ctx is done
+func (s Sinks) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, sink := range s {
+		errs = append(errs, shutdown(ctx, sink))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdowner is implemented by sinks flushing slowly, e.g. over the network
+type Shutdowner interface {
+	// Shutdown flushes and closes the sink, dropping what is left once ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+func shutdown(ctx context.Context, sink Sink) error {
+	switch c := sink.(type) {
+	case Shutdowner:
+		return c.Shutdown(ctx)
+	case io.Closer:
+		return c.Close()
+	}
+
+	return nil
+}
+
+// FilteredSink publishes to Sink only the flow events matching Filter, other events pass through
+type FilteredSink struct {
+	Sink
+
+	Filter *filter.Expr
+}
+
+func (s *FilteredSink) Publish(event *model.Event) {
+	if event.Flow != nil && !s.Filter.Match(event.Flow) {
+		return
+	}
+
+	s.Sink.Publish(event)
+}
+
+// Close closes Sink if it is an io.Closer
+func (s *FilteredSink) Close() error {
+	return shutdown(context.Background(), s.Sink)
+}
+
+// Shutdown shuts Sink down if it is a Shutdowner, or closes it
+func (s *FilteredSink) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, s.Sink)
+}
+
+// ValidateEventTypes reports unknown event types
+func ValidateEventTypes(types []string) error {
+	for _, typ := range types {
+		if !slices.Contains(model.EventTypes, typ) {
+			return fmt.Errorf("unknown event type %q", typ)
+		}
+	}
+
+	return nil
+}
+
+// sinkQueue decouples a sink from the publishers
+// the sink consumes it from its own goroutine, events are dropped while it falls behind
+type sinkQueue struct {
+	// recorded event types
+	types []string
+
+	events  chan *model.Event
+	dropped atomic.Int64
+
+	// closed when the sink closes, then once the consumer flushed the remaining events
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newSinkQueue(types []string) *sinkQueue {
+	if len(types) == 0 {
+		types = DefaultSinkEvents
+	}
+
+	return &sinkQueue{
+		types:   types,
+		events:  make(chan *model.Event, DefaultQueueSize),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (q *sinkQueue) push(event *model.Event) {
+	if !slices.Contains(q.types, event.Type) {
+		return
+	}
+
+	select {
+	case <-q.closing:
+		return
+	default:
+	}
+
+	select {
+	case q.events <- event:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// take returns event and the events queued after it without waiting,
+// led by a dropped notice if events were dropped, event may be nil
+func (q *sinkQueue) take(event *model.Event) []*model.Event {
+	var events []*model.Event
+	if dropped := q.dropped.Swap(0); dropped > 0 {
+		events = append(events, DroppedNotice(dropped))
+	}
+	if event != nil {
+		events = append(events, event)
+	}
+
+	for {
+		select {
+		case event := <-q.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// close signals the consumer and waits until it flushed
+func (q *sinkQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closing)
+	})
+	<-q.stopped
+}
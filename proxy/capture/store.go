@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// DefaultStoreSize is the number of flows kept in memory
+const DefaultStoreSize = 1000
+
+// Store keeps the most recent flows in memory
+// every stored flow gets a sequence number subscribers use as a resumable cursor
+type Store struct {
+	mu    sync.RWMutex
+	flows []*model.PacketCaptureFlow
+	head  int
+	count int
+	seq   uint64
+}
+
+func NewStore(size int) *Store {
+	if size <= 0 {
+		size = DefaultStoreSize
+	}
+
+	return &Store{
+		flows: make([]*model.PacketCaptureFlow, size),
+	}
+}
+
+// Add stores the flow, evicting the oldest one when full, and assigns its sequence number
+func (s *Store) Add(flow *model.PacketCaptureFlow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	flow.Seq = s.seq
+
+	s.flows[(s.head+s.count)%len(s.flows)] = flow
+	if s.count < len(s.flows) {
+		s.count++
+	} else {
+		s.head = (s.head + 1) % len(s.flows)
+	}
+}
+
+// Flows returns the stored flows, oldest first
+func (s *Store) Flows() []*model.PacketCaptureFlow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.snapshot()
+}
+
+// Get returns the stored flow with id
+func (s *Store) Get(id string) (*model.PacketCaptureFlow, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, flow := range s.snapshot() {
+		if flow.ID == id {
+			return flow, true
+		}
+	}
+
+	return nil, false
+}
+
+// Backlog selects the stored flows requested by b, oldest first
+// missed is the number of flows after the cursor that were already evicted
+func (s *Store) Backlog(b *Backlog) (flows []*model.PacketCaptureFlow, missed uint64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	flows = s.snapshot()
+
+	cursor := b.Cursor
+	if len(b.After) > 0 {
+		i := slices.IndexFunc(flows, func(flow *model.PacketCaptureFlow) bool { return flow.ID == b.After })
+		if i < 0 {
+			return nil, 0, fmt.Errorf("flow %q is not stored", b.After)
+		}
+		cursor = flows[i].Seq
+	}
+	if cursor > 0 {
+		// seq of the last evicted flow
+		if evicted := s.seq - uint64(len(flows)); cursor < evicted {
+			missed = evicted - cursor
+		}
+		flows = slices.DeleteFunc(flows, func(flow *model.PacketCaptureFlow) bool { return flow.Seq <= cursor })
+	}
+
+	if !b.Since.IsZero() {
+		flows = slices.DeleteFunc(flows, func(flow *model.PacketCaptureFlow) bool {
+			return flow.Timing == nil || flow.Timing.RequestStart.Before(b.Since)
+		})
+	}
+
+	if b.Last > 0 && len(flows) > b.Last {
+		flows = flows[len(flows)-b.Last:]
+	}
+
+	return flows, missed, nil
+}
+
+func (s *Store) snapshot() []*model.PacketCaptureFlow {
+	flows := make([]*model.PacketCaptureFlow, 0, s.count)
+	for i := range s.count {
+		flows = append(flows, s.flows[(s.head+i)%len(s.flows)])
+	}
+
+	return flows
+}
+
+// Backlog selects stored flows sent to a subscriber before live streaming, set fields combine
+type Backlog struct {
+	// at most the last n flows
+	Last int `json:"last,omitempty"`
+
+	// flows started at or after
+	Since time.Time `json:"since,omitzero"`
+
+	// flows stored after the flow with this id
+	After string `json:"after,omitempty"`
+
+	// flows with a sequence number above the cursor, the seq of the last flow received
+	Cursor uint64 `json:"cursor,omitempty"`
+}
+
+// Validate reports conflicting backlog fields
+func (b *Backlog) Validate() error {
+	if len(b.After) > 0 && b.Cursor > 0 {
+		return errors.New("backlog after and cursor are mutually exclusive")
+	}
+	if b.Last < 0 {
+		return errors.New("backlog last must not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package capture
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// testStore holds flows 1 to 5 of a store of 3, started a minute apart, so 1 and 2 are evicted
+func testStore() *Store {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewStore(3)
+	for i := 1; i <= 5; i++ {
+		flow := testFlow(fmt.Sprint(i), "http://example.com/")
+		flow.Timing = &model.Timing{RequestStart: start.Add(time.Duration(i) * time.Minute)}
+		store.Add(flow)
+	}
+
+	return store
+}
+
+func ids(flows []*model.PacketCaptureFlow) []string {
+	ids := make([]string, 0, len(flows))
+	for _, flow := range flows {
+		ids = append(ids, flow.ID)
+	}
+
+	return ids
+}
+
+func TestStoreWrapsAround(t *testing.T) {
+	store := testStore()
+
+	if got := ids(store.Flows()); !slices.Equal(got, []string{"3", "4", "5"}) {
+		t.Errorf("Flows() = %v, want [3 4 5]", got)
+	}
+	for i, flow := range store.Flows() {
+		if want := uint64(i + 3); flow.Seq != want {
+			t.Errorf("flow %s seq = %d, want %d", flow.ID, flow.Seq, want)
+		}
+	}
+	if _, ok := store.Get("2"); ok {
+		t.Error("Get(2) found an evicted flow")
+	}
+	if flow, ok := store.Get("4"); !ok || flow.ID != "4" {
+		t.Errorf("Get(4) = %v, %v", flow, ok)
+	}
+}
+
+func TestStoreBacklog(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 4, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		backlog Backlog
+		want    []string
+		missed  uint64
+	}{
+		{"everything", Backlog{}, []string{"3", "4", "5"}, 0},
+		{"last", Backlog{Last: 2}, []string{"4", "5"}, 0},
+		{"last above the count", Backlog{Last: 10}, []string{"3", "4", "5"}, 0},
+		{"since", Backlog{Since: since}, []string{"4", "5"}, 0},
+		{"after", Backlog{After: "3"}, []string{"4", "5"}, 0},
+		{"after the newest", Backlog{After: "5"}, []string{}, 0},
+		{"cursor", Backlog{Cursor: 4}, []string{"5"}, 0},
+		{"cursor of the last evicted flow", Backlog{Cursor: 2}, []string{"3", "4", "5"}, 0},
+		{"evicted cursor", Backlog{Cursor: 1}, []string{"3", "4", "5"}, 1},
+		{"cursor and last", Backlog{Cursor: 3, Last: 1}, []string{"5"}, 0},
+	}
+
+	store := testStore()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows, missed, err := store.Backlog(&tt.backlog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(flows); !slices.Equal(got, tt.want) || missed != tt.missed {
+				t.Errorf("Backlog() = %v, missed %d, want %v, missed %d", got, missed, tt.want, tt.missed)
+			}
+		})
+	}
+
+	if _, _, err := store.Backlog(&Backlog{After: "1"}); err == nil {
+		t.Error("Backlog after an evicted flow succeeded, want an error")
+	}
+}
+
+func TestBacklogValidate(t *testing.T) {
+	for _, b := range []Backlog{{After: "1", Cursor: 1}, {Last: -1}} {
+		if err := b.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want an error", b)
+		}
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	hub := NewHub(0, testStore())
+	sub := hub.Subscribe()
+	// queued before the replay, discarded by it
+	hub.Publish(model.NewFlowEvent(model.EventRequestStarted, testFlow("live", "http://example.com/")))
+
+	subscription := &Subscription{Expr: filter.MustParse("not conn:x")}
+	if err := hub.Replay(sub, subscription, &Backlog{Cursor: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sub.Events()); n != 0 {
+		t.Errorf("%d events left queued, want the queue drained", n)
+	}
+	if sub.Subscription() != subscription {
+		t.Error("the subscription is not replaced")
+	}
+
+	var got []string
+	for _, event := range sub.TakeBacklog() {
+		if event.Notice != nil {
+			got = append(got, event.Notice.Notice)
+		} else {
+			got = append(got, event.Flow.ID)
+		}
+	}
+	if want := []string{"subscribed", "missed", "3", "4", "5"}; !slices.Equal(got, want) {
+		t.Errorf("backlog = %v, want %v", got, want)
+	}
+	if backlog := sub.TakeBacklog(); len(backlog) != 0 {
+		t.Errorf("backlog taken twice, second = %v", backlog)
+	}
+}
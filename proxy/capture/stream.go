@@ -0,0 +1,311 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// stream formats
+const (
+	// text/event-stream, one event per message named after the event type
+	FormatSSE = "sse"
+
+	// application/x-ndjson, one event per line
+	FormatNDJSON = "ndjson"
+)
+
+// PacketCaptureStream streams the hub over long-lived http responses, for clients without a websocket library
+// the subscription and backlog are read from the query, using the names of their json fields,
+// e.g. ?host=*.example.com&status_min=400&omit=request.body,response.body&last=50,
+// filter takes a filter expression, e.g. ?filter=status:5xx or duration>2s
+type PacketCaptureStream struct {
+	enabled bool
+	hub     *Hub
+
+	// closed once the server serving the streams shuts down
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Handler returns the handler streaming in format
+func (p *PacketCaptureStream) Handler(format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.serve(w, r, format)
+	})
+}
+
+// Close ends the open streams
+// the server waits for them on shutdown, so it should be called once shutdown starts
+func (p *PacketCaptureStream) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+}
+
+func (p *PacketCaptureStream) serve(w http.ResponseWriter, r *http.Request, format string) {
+	if !p.enabled {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	subscription, backlog, err := parseStreamQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == FormatSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sub := p.hub.Subscribe()
+	defer p.hub.Unsubscribe(sub)
+
+	if backlog == nil {
+		sub.Subscribe(subscription)
+		sub.Notify(SubscribedNotice())
+	} else if err := p.hub.Replay(sub, subscription, backlog); err != nil {
+		sub.Notify(ErrorNotice(err))
+	}
+
+	s := &stream{w: w, rc: http.NewResponseController(w), format: format}
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.Backlog():
+			if err := s.writeBacklog(sub); err != nil {
+				return
+			}
+		case event := <-sub.Events():
+			if err := s.writeBacklog(sub); err != nil {
+				return
+			}
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				if err := s.write(DroppedNotice(dropped)); err != nil {
+					return
+				}
+			}
+			if err := s.write(sub.Subscription().Project(event)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.ping(); err != nil {
+				return
+			}
+		case <-sub.Done():
+			return
+		case <-p.closing:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// stream writes events to a single response
+type stream struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	format string
+}
+
+func (s *stream) writeBacklog(sub *Subscriber) error {
+	for _, event := range sub.TakeBacklog() {
+		if err := s.write(sub.Subscription().Project(event)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *stream) write(event *model.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if s.format == FormatSSE {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// ping keeps idle event streams open through intermediaries
+// ndjson has no comment syntax, so idle ndjson streams stay silent
+func (s *stream) ping() error {
+	if s.format != FormatSSE {
+		return nil
+	}
+
+	s.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := fmt.Fprint(s.w, ": ping\n\n"); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// parseStreamQuery reads the subscription and the backlog of a stream from the query
+// the backlog is nil when no backlog parameter is set
+func parseStreamQuery(q url.Values) (*Subscription, *Backlog, error) {
+	expr, err := queryExpr(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	subscription := &Subscription{Expr: expr}
+	for _, omit := range q["omit"] {
+		subscription.Omit = append(subscription.Omit, strings.Split(omit, ",")...)
+	}
+
+	backlog := &Backlog{After: q.Get("after")}
+	if v := q.Get("last"); len(v) > 0 {
+		if backlog.Last, err = strconv.Atoi(v); err != nil {
+			return nil, nil, fmt.Errorf("invalid last %q", v)
+		}
+	}
+	if v := q.Get("since"); len(v) > 0 {
+		if backlog.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, nil, fmt.Errorf("invalid since %q, want rfc3339", v)
+		}
+	}
+	if v := q.Get("cursor"); len(v) > 0 {
+		if backlog.Cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("invalid cursor %q", v)
+		}
+	}
+
+	if err := subscription.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if *backlog == (Backlog{}) {
+		return subscription, nil, nil
+	}
+	if err := backlog.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return subscription, backlog, nil
+}
+
+// queryExpr reads the filter expression of a stream query
+// host, method, status_min, status_max, content_type, path and conn_id predate the filter parameter,
+// they are translated to the terms they stand for and and-ed to it
+func queryExpr(q url.Values) (*filter.Expr, error) {
+	src := q.Get("filter")
+	if _, err := filter.Parse(src); err != nil {
+		return nil, err
+	}
+
+	var terms []string
+	add := func(field, op, value string) {
+		terms = append(terms, field+op+strconv.Quote(value))
+	}
+	if v := q.Get("host"); len(v) > 0 {
+		add("host", ":", v)
+	}
+	if v := q.Get("method"); len(v) > 0 {
+		add("method", ":", v)
+	}
+	for _, bound := range []struct{ name, op string }{{"status_min", ">="}, {"status_max", "<="}} {
+		v := q.Get(bound.name)
+		if len(v) == 0 {
+			continue
+		}
+		// zero bounds are open
+		if n, err := strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", bound.name, v)
+		} else if n != 0 {
+			add("status", bound.op, v)
+		}
+	}
+	if v := q.Get("content_type"); len(v) > 0 {
+		add("respheader", ":", "Content-Type=(?i)"+regexp.QuoteMeta(v))
+	}
+	if v := q.Get("path"); len(v) > 0 {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("path %q: %w", v, err)
+		}
+		add("path", ":", globRegexp(v))
+	}
+	if v := q.Get("conn_id"); len(v) > 0 {
+		add("conn", ":", v)
+	}
+	if len(terms) == 0 {
+		return filter.Parse(src)
+	}
+	if len(strings.TrimSpace(src)) > 0 {
+		terms = append(terms, "("+src+")")
+	}
+
+	return filter.Parse(strings.Join(terms, " "))
+}
+
+// globRegexp translates a path.Match glob to an anchored regexp, * and ? do not match /
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			// classes read the same, path.Match has already checked they are closed
+			b.WriteByte('[')
+			for i++; glob[i] != ']'; i++ {
+				if glob[i] == '\\' {
+					i++
+					b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+					continue
+				}
+				b.WriteByte(glob[i])
+			}
+			b.WriteByte(']')
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
+
+func NewPacketCaptureStream(hub *Hub, enabled bool) *PacketCaptureStream {
+	return &PacketCaptureStream{
+		enabled: enabled,
+		hub:     hub,
+		closing: make(chan struct{}),
+	}
+}
@@ -0,0 +1,90 @@
+package capture
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+func TestQueryExpr(t *testing.T) {
+	flow := &model.PacketCaptureFlow{
+		Request:    &model.Request{Method: http.MethodPost, Url: "https://api.example.com/v1/users"},
+		Response:   &model.Response{StatusCode: http.StatusNotFound, Header: http.Header{"Content-Type": {"Application/JSON"}}},
+		ClientConn: &model.ConnInfo{ID: "client"},
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"host=*.example.com", true},
+		{"host=*.EXAMPLE.com&method=post", true},
+		{"host=example.com", false},
+		{"status_min=400&status_max=499", true},
+		{"status_min=0&status_max=0", true},
+		{"status_max=403", false},
+		{"content_type=json", true},
+		{"content_type=.json", false},
+		{"path=/v1/*", true},
+		{"path=/*", false},
+		{"conn_id=client", true},
+		{"conn_id=other", false},
+		{"method=POST&filter=status:5xx or path:users", true},
+		{"method=GET&filter=status:5xx or path:users", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			expr, err := queryExpr(q)
+			if err != nil {
+				t.Fatalf("queryExpr(%q): %v", tt.query, err)
+			}
+			if got := expr.Match(flow); got != tt.want {
+				t.Errorf("queryExpr(%q) = %q, matches %v, want %v", tt.query, expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryExprError(t *testing.T) {
+	for _, query := range []string{"status_min=x", "path=[", "filter=stauts:404", "host=x&filter=(status:5xx"} {
+		q, _ := url.ParseQuery(query)
+		if _, err := queryExpr(q); err == nil {
+			t.Errorf("queryExpr(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, name string
+	}{
+		{"/api/*", "/api/users"},
+		{"/api/*", "/api/users/1"},
+		{"/api/*", "/api"},
+		{"/a?c", "/abc"},
+		{"/a?c", "/a/c"},
+		{"/v[12]/x", "/v1/x"},
+		{"/v[^12]/x", "/v1/x"},
+		{"/v[a-c]", "/vb"},
+		{`/a\*b`, "/a*b"},
+		{`/a\*b`, "/axb"},
+		{"/a.b", "/axb"},
+		{"/a+b", "/a+b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.name, func(t *testing.T) {
+			want, _ := path.Match(tt.glob, tt.name)
+			if got := regexp.MustCompile(globRegexp(tt.glob)).MatchString(tt.name); got != want {
+				t.Errorf("globRegexp(%q) matches %q = %v, path.Match = %v", tt.glob, tt.name, got, want)
+			}
+		})
+	}
+}
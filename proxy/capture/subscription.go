@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"fmt"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// Subscription selects and shapes the messages a subscriber receives
+// it is applied by the hub before messages are queued and serialized
+type Subscription struct {
+	// flows not matching the filter expression are not sent, see the filter package
+	Expr *filter.Expr `json:"expr,omitempty"`
+
+	// flow fields left out of the sent flows
+	// request.body, request.header, response.body, response.header, response.cookies,
+	// timing, client_conn, server_conn
+	Omit []string `json:"omit,omitempty"`
+}
+
+// omittable flow fields
+var omitFields = map[string]struct{}{
+	"request.body":     {},
+	"request.header":   {},
+	"response.body":    {},
+	"response.header":  {},
+	"response.cookies": {},
+	"timing":           {},
+	"client_conn":      {},
+	"server_conn":      {},
+}
+
+// Validate reports unknown omitted fields
+func (s *Subscription) Validate() error {
+	for _, field := range s.Omit {
+		if _, ok := omitFields[field]; !ok {
+			return fmt.Errorf("unknown omitted field %q", field)
+		}
+	}
+
+	return nil
+}
+
+// Accepts reports whether the flow events match the expression
+// connection events are only filtered by the conn terms of the expression
+func (s *Subscription) Accepts(event *model.Event) bool {
+	if s == nil || s.Expr.Empty() {
+		return true
+	}
+
+	switch {
+	case event.Flow != nil:
+		return s.Expr.Match(event.Flow)
+	case event.Connection != nil:
+		return s.Expr.MatchConn(event.Connection)
+	default:
+		return true
+	}
+}
+
+// Project returns the event without the omitted flow fields, the event itself is left untouched
+func (s *Subscription) Project(event *model.Event) *model.Event {
+	if s == nil || len(s.Omit) == 0 || event.Flow == nil {
+		return event
+	}
+
+	flow := event.Flow
+	projected := *flow
+	if flow.Request != nil {
+		req := *flow.Request
+		projected.Request = &req
+	}
+	if flow.Response != nil {
+		resp := *flow.Response
+		projected.Response = &resp
+	}
+
+	for _, field := range s.Omit {
+		switch field {
+		case "request.body":
+			if projected.Request != nil {
+				projected.Request.Body = nil
+			}
+		case "request.header":
+			if projected.Request != nil {
+				projected.Request.Header = nil
+			}
+		case "response.body":
+			if projected.Response != nil {
+				projected.Response.Body = nil
+			}
+		case "response.header":
+			if projected.Response != nil {
+				projected.Response.Header = nil
+			}
+		case "response.cookies":
+			if projected.Response != nil {
+				projected.Response.Cookies = nil
+			}
+		case "timing":
+			projected.Timing = nil
+		case "client_conn":
+			projected.ClientConn = nil
+		case "server_conn":
+			projected.ServerConn = nil
+		}
+	}
+
+	projectedEvent := *event
+	projectedEvent.Flow = &projected
+	return &projectedEvent
+}
@@ -0,0 +1,223 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/sirupsen/logrus"
+)
+
+// webhook defaults
+const (
+	DefaultWebhookBatchSize     = 100
+	DefaultWebhookFlushInterval = time.Second
+	DefaultWebhookRetries       = 5
+	DefaultWebhookBackoff       = 500 * time.Millisecond
+
+	// upper bound of the backoff between retries
+	maxWebhookBackoff = 30 * time.Second
+
+	// time allowed for a single post
+	webhookTimeout = 10 * time.Second
+)
+
+type WebhookConfig struct {
+	// endpoint the batches are posted to
+	URL string
+
+	// extra request headers, e.g. Authorization
+	Header http.Header
+
+	// max events per batch
+	BatchSize int
+
+	// time a partial batch waits before it is posted
+	FlushInterval time.Duration
+
+	// retries of a failed post, negative disables
+	Retries int
+
+	// backoff before the first retry, doubled on each further retry
+	Backoff time.Duration
+
+	// recorded event types, DefaultSinkEvents when empty
+	Events []string
+}
+
+// WebhookSink posts events in batches, as a json array, to a webhook
+// failed posts are retried with exponential backoff on network errors, 408, 429 and 5xx,
+// a batch that still fails is dropped. Once the sink closes, the remaining batches get a single attempt
+type WebhookSink struct {
+	conf   WebhookConfig
+	client *http.Client
+	logger logrus.FieldLogger
+	queue  *sinkQueue
+
+	// canceled to abort the posts when shutdown runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *WebhookSink) Publish(event *model.Event) {
+	s.queue.push(event)
+}
+
+// Close posts the queued events
+func (s *WebhookSink) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown posts the queued events until ctx is done, then aborts the post in flight and drops the rest
+func (s *WebhookSink) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.queue.close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.queue.stopped)
+
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*model.Event
+	for {
+		select {
+		case event := <-s.queue.events:
+			batch = s.sendFull(append(batch, s.queue.take(event)...))
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(batch)
+				batch = nil
+			}
+		case <-s.queue.closing:
+			batch = s.sendFull(append(batch, s.queue.take(nil)...))
+			if len(batch) > 0 {
+				s.send(batch)
+			}
+			return
+		}
+	}
+}
+
+// sendFull posts the full batches in events and returns the rest
+func (s *WebhookSink) sendFull(events []*model.Event) []*model.Event {
+	for len(events) >= s.conf.BatchSize {
+		s.send(events[:s.conf.BatchSize])
+		events = events[s.conf.BatchSize:]
+	}
+
+	return events
+}
+
+func (s *WebhookSink) send(batch []*model.Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		s.logger.Errorf("webhook sink: %v", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := s.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= s.conf.Retries {
+			s.logger.Errorf("webhook sink: dropping %d events: %v", len(batch), err)
+			return
+		}
+
+		if wait == 0 {
+			wait = min(s.conf.Backoff<<attempt, maxWebhookBackoff)
+			wait = wait/2 + rand.N(wait/2+1)
+		}
+		s.logger.Warnf("webhook sink: %v, retrying in %s", err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-s.queue.closing:
+			s.logger.Errorf("webhook sink: dropping %d events: %v", len(batch), err)
+			return
+		}
+	}
+}
+
+// post posts a batch once, reporting whether a failure is worth retrying and the wait the server asked for
+func (s *WebhookSink) post(body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	for name, values := range s.conf.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 300 {
+		return false, 0, nil
+	}
+
+	err = fmt.Errorf("webhook responded %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		var wait time.Duration
+		if seconds, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+			wait = min(time.Duration(seconds)*time.Second, maxWebhookBackoff)
+		}
+		return true, wait, err
+	default:
+		return false, 0, err
+	}
+}
+
+func NewWebhookSink(conf *WebhookConfig, logger logrus.FieldLogger) *WebhookSink {
+	s := &WebhookSink{
+		conf:   *conf,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+		queue:  newSinkQueue(conf.Events),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.conf.BatchSize <= 0 {
+		s.conf.BatchSize = DefaultWebhookBatchSize
+	}
+	if s.conf.FlushInterval <= 0 {
+		s.conf.FlushInterval = DefaultWebhookFlushInterval
+	}
+	if s.conf.Retries == 0 {
+		s.conf.Retries = DefaultWebhookRetries
+	}
+	if s.conf.Backoff <= 0 {
+		s.conf.Backoff = DefaultWebhookBackoff
+	}
+	go s.run()
+
+	return s
+}
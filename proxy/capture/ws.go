@@ -0,0 +1,179 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// time allowed to write a message, a client that can't keep up for longer is disconnected
+	writeWait = 10 * time.Second
+
+	// time allowed to read the next pong from the client
+	pongWait = 60 * time.Second
+
+	// send pings with this period, must be less than pongWait
+	pingPeriod = pongWait * 9 / 10
+)
+
+// PacketCaptureWebSocket streams the hub to websocket clients
+type PacketCaptureWebSocket struct {
+	logger   logrus.FieldLogger
+	enabled  bool
+	hub      *Hub
+	upgrader *websocket.Upgrader
+}
+
+func (p *PacketCaptureWebSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.enabled {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		p.logger.Error(err)
+		return
+	}
+
+	sub := p.hub.Subscribe()
+	go p.readPump(c, sub)
+	go p.writePump(c, sub)
+}
+
+// clientMessage is a control message sent by a capture client
+type clientMessage struct {
+	// message type, e.g. subscribe
+	Type string `json:"type"`
+
+	Subscription
+
+	// stored flows sent before live streaming starts
+	Backlog *Backlog `json:"backlog,omitempty"`
+}
+
+// readPump handles client messages and keeps the read deadline alive on pongs
+// the subscriber is dropped once the client goes away
+func (p *PacketCaptureWebSocket) readPump(c *websocket.Conn, sub *Subscriber) {
+	defer p.hub.Unsubscribe(sub)
+
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg clientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			sub.Notify(ErrorNotice(err))
+			continue
+		}
+		p.handleMessage(sub, &msg)
+	}
+}
+
+func (p *PacketCaptureWebSocket) handleMessage(sub *Subscriber, msg *clientMessage) {
+	switch msg.Type {
+	case "subscribe":
+		if err := msg.Subscription.Validate(); err != nil {
+			sub.Notify(ErrorNotice(err))
+			return
+		}
+
+		if msg.Backlog == nil {
+			sub.Subscribe(&msg.Subscription)
+			sub.Notify(SubscribedNotice())
+			return
+		}
+		if err := msg.Backlog.Validate(); err != nil {
+			sub.Notify(ErrorNotice(err))
+			return
+		}
+		if err := p.hub.Replay(sub, &msg.Subscription, msg.Backlog); err != nil {
+			sub.Notify(ErrorNotice(err))
+		}
+	default:
+		sub.Notify(ErrorNotice(fmt.Errorf("unknown message type %q", msg.Type)))
+	}
+}
+
+// writePump is the only writer of the conn, it drains the subscriber queue and pings the client
+func (p *PacketCaptureWebSocket) writePump(c *websocket.Conn, sub *Subscriber) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+	}()
+
+	for {
+		select {
+		case <-sub.Backlog():
+			if err := p.writeBacklog(c, sub); err != nil {
+				return
+			}
+		case event := <-sub.Events():
+			if err := p.writeBacklog(c, sub); err != nil {
+				return
+			}
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				if err := p.writeJSON(c, DroppedNotice(dropped)); err != nil {
+					return
+				}
+			}
+			if err := p.writeJSON(c, sub.Subscription().Project(event)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-sub.Done():
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy stopped")
+			c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+func (p *PacketCaptureWebSocket) writeBacklog(c *websocket.Conn, sub *Subscriber) error {
+	for _, event := range sub.TakeBacklog() {
+		if err := p.writeJSON(c, sub.Subscription().Project(event)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *PacketCaptureWebSocket) writeJSON(c *websocket.Conn, event *model.Event) error {
+	c.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.WriteJSON(event); err != nil {
+		p.logger.Debugf("capture websocket write: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func NewPacketCaptureWebsocket(hub *Hub, enabled bool, logger logrus.FieldLogger) *PacketCaptureWebSocket {
+	return &PacketCaptureWebSocket{
+		logger:  logger,
+		enabled: enabled,
+		hub:     hub,
+		upgrader: &websocket.Upgrader{
+			// origins are checked by Access before the upgrade
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
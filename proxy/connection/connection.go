@@ -5,6 +5,10 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/google/uuid"
 )
 
 // EnhancedConn is a net.Conn with connection session
@@ -14,11 +18,24 @@ type EnhancedConn struct {
 	Session *ProxyConnSession
 }
 
-func NewEnhancedConn(c net.Conn) *EnhancedConn {
+// NewEnhancedConn wraps an accepted client conn, events receives the lifecycle events of the session
+func NewEnhancedConn(c net.Conn, events EventFunc) *EnhancedConn {
+	session := NewProxyConnSession(c, events)
 	return &EnhancedConn{
-		Conn:    c,
-		Session: NewProxyConnSession(c),
+		Conn:    session.ClientConn.Conn,
+		Session: session,
+	}
+}
+
+// Reset closes the client conn with a tcp reset rather than gracefully, e.g. to simulate a failing server
+func (c *EnhancedConn) Reset() error {
+	if cc, ok := c.Session.ClientConn.Conn.(*CountingConn); ok {
+		if tcpConn, ok := cc.Conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
 	}
+
+	return c.Close()
 }
 
 // Dialer is an interface for dialing connections
@@ -27,18 +44,90 @@ type Dialer interface {
 	Dial(context.Context, *http.Request) (net.Conn, error)
 }
 
+// EventFunc receives connection lifecycle events
+type EventFunc func(*model.ConnectionEvent)
+
 // ProxyConnSession is a session for a proxy connection
 type ProxyConnSession struct {
 	Dialer
 
 	ClientConn *ProxyClientConn
 	ServerConn *ProxyServerConn
+
+	// connection level timing shared by the flows of this session
+	Timing model.Timing
+
+	events EventFunc
+}
+
+func NewProxyConnSession(c net.Conn, events EventFunc) *ProxyConnSession {
+	s := &ProxyConnSession{
+		Timing: model.Timing{
+			ClientConnect: time.Now(),
+		},
+		events: events,
+	}
+
+	s.ClientConn = NewProxyClientConn(NewCountingConn(c, func(cc *CountingConn) {
+		event := s.ClientConn.Event(model.ConnClosed)
+		event.BytesRead, event.BytesWritten = cc.BytesRead(), cc.BytesWritten()
+		s.Emit(event)
+
+		// the upstream conn does not outlive its client
+		if s.ServerConn != nil {
+			s.ServerConn.Conn.Close()
+		}
+	}))
+	s.Emit(s.ClientConn.Event(model.ConnOpened))
+
+	return s
+}
+
+// NewServerConn tracks an upstream conn dialed on behalf of the session and reports it opened
+// the conn is not attached to the session so it can be pooled and shared with other sessions,
+// its events carry no client conn id, the flows sent over it record it instead
+func (s *ProxyConnSession) NewServerConn(c net.Conn) *ProxyServerConn {
+	return s.newServerConn(c, false)
+}
+
+// SetServerConn attaches the dialed upstream conn to the session and reports it opened
+func (s *ProxyConnSession) SetServerConn(c net.Conn) *ProxyServerConn {
+	s.ServerConn = s.newServerConn(c, true)
+	return s.ServerConn
+}
+
+func (s *ProxyConnSession) newServerConn(c net.Conn, attached bool) *ProxyServerConn {
+	emit := s.emit
+	if attached {
+		emit = s.Emit
+	}
+
+	var serverConn *ProxyServerConn
+	serverConn = NewProxyServerConn(NewCountingConn(c, func(cc *CountingConn) {
+		event := serverConn.Event(model.ConnClosed)
+		event.BytesRead, event.BytesWritten = cc.BytesRead(), cc.BytesWritten()
+		emit(event)
+	}))
+	emit(serverConn.Event(model.ConnOpened))
+
+	return serverConn
 }
 
-func NewProxyConnSession(c net.Conn) *ProxyConnSession {
-	return &ProxyConnSession{
-		ClientConn: NewProxyClientConn(c),
+// Emit publishes a connection event of the session, server side events are linked to the client conn
+func (s *ProxyConnSession) Emit(event *model.ConnectionEvent) {
+	if event.Side == model.ServerSide {
+		event.ClientConnID = s.ClientConn.ID
 	}
+	s.emit(event)
+}
+
+func (s *ProxyConnSession) emit(event *model.ConnectionEvent) {
+	if s.events == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	s.events(event)
 }
 
 // ProxyClientConn is a connection from the client to the proxy
@@ -52,22 +141,52 @@ type ProxyClientConn struct {
 
 func NewProxyClientConn(c net.Conn) *ProxyClientConn {
 	return &ProxyClientConn{
+		ID:   uuid.NewString(),
 		Conn: c,
 	}
 }
 
+// Info returns the identity of the conn recorded on flows
+func (c *ProxyClientConn) Info() *model.ConnInfo {
+	return &model.ConnInfo{
+		ID:         c.ID,
+		RemoteAddr: c.Conn.RemoteAddr().String(),
+		LocalAddr:  c.Conn.LocalAddr().String(),
+		TLS:        c.IsTLS,
+	}
+}
+
+// Event builds a lifecycle event of the conn
+func (c *ProxyClientConn) Event(name string) *model.ConnectionEvent {
+	event := &model.ConnectionEvent{
+		Event:      name,
+		Side:       model.ClientSide,
+		ID:         c.ID,
+		RemoteAddr: c.Conn.RemoteAddr().String(),
+		LocalAddr:  c.Conn.LocalAddr().String(),
+	}
+	if c.IsTLS {
+		setTLSState(event, c.TlsConn.ConnectionState())
+	}
+
+	return event
+}
+
 // ProxyServerConn is a connection from the proxy to the server
 type ProxyServerConn struct {
+	net.Conn
+
 	ID           string
 	TlsConn      *tls.Conn
 	TlsConnState *tls.ConnectionState
 	Addr         string
 	Client       *http.Client
-	Conn         net.Conn
 }
 
 func NewProxyServerConn(c net.Conn) *ProxyServerConn {
 	return &ProxyServerConn{
+		ID:   uuid.NewString(),
+		Addr: c.RemoteAddr().String(),
 		Conn: c,
 		Client: &http.Client{
 			Transport: &http.Transport{
@@ -82,3 +201,35 @@ func NewProxyServerConn(c net.Conn) *ProxyServerConn {
 		},
 	}
 }
+
+// Info returns the identity of the conn recorded on flows
+func (c *ProxyServerConn) Info() *model.ConnInfo {
+	return &model.ConnInfo{
+		ID:         c.ID,
+		RemoteAddr: c.Addr,
+		LocalAddr:  c.Conn.LocalAddr().String(),
+		TLS:        c.TlsConn != nil,
+	}
+}
+
+// Event builds a lifecycle event of the conn
+func (c *ProxyServerConn) Event(name string) *model.ConnectionEvent {
+	event := &model.ConnectionEvent{
+		Event:      name,
+		Side:       model.ServerSide,
+		ID:         c.ID,
+		RemoteAddr: c.Addr,
+		LocalAddr:  c.Conn.LocalAddr().String(),
+	}
+	if c.TlsConnState != nil {
+		setTLSState(event, *c.TlsConnState)
+	}
+
+	return event
+}
+
+func setTLSState(event *model.ConnectionEvent, state tls.ConnectionState) {
+	event.TLSVersion = tls.VersionName(state.Version)
+	event.ServerName = state.ServerName
+	event.ALPN = state.NegotiatedProtocol
+}
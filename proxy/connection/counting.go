@@ -0,0 +1,56 @@
+package connection
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// CountingConn is a net.Conn that counts transferred bytes and reports its close once
+type CountingConn struct {
+	net.Conn
+
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	closeOnce    sync.Once
+	onClose      func(*CountingConn)
+}
+
+func NewCountingConn(c net.Conn, onClose func(*CountingConn)) *CountingConn {
+	return &CountingConn{
+		Conn:    c,
+		onClose: onClose,
+	}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+	return err
+}
+
+// BytesRead returns the number of bytes read from the conn
+func (c *CountingConn) BytesRead() int64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written to the conn
+func (c *CountingConn) BytesWritten() int64 {
+	return c.bytesWritten.Load()
+}
@@ -0,0 +1,51 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// WithDialTrace returns a context that records upstream dns and tcp connect durations into timing
+func WithDialTrace(ctx context.Context, timing *model.Timing) context.Context {
+	var dnsStart, connectStart time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timing.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				timing.TCPConnect = time.Since(connectStart)
+			}
+		},
+	})
+}
+
+// WithRequestTrace returns a context that records when the request was sent
+// and when the first response byte arrived into timing, including dial and tls timing when the request dials
+func WithRequestTrace(ctx context.Context, timing *model.Timing) context.Context {
+	var tlsStart time.Time
+	return httptrace.WithClientTrace(WithDialTrace(ctx, timing), &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timing.UpstreamTLS = time.Since(tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			timing.RequestSent = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			timing.FirstResponseByte = time.Now()
+		},
+	})
+}
@@ -0,0 +1,486 @@
+package intercept
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a breakpoint waits for a client unless configured otherwise
+const DefaultTimeout = 5 * time.Minute
+
+// Rules select the flows paused in each phase, an empty rule pauses nothing
+type Rules struct {
+	Request  *filter.Expr `json:"request"`
+	Response *filter.Expr `json:"response"`
+}
+
+type Config struct {
+	Rules
+
+	// how long a breakpoint waits for a client, DefaultTimeout by default
+	Timeout time.Duration
+
+	// how breakpoints nobody resolved in time are resolved, model.ResolveResume by default
+	OnTimeout string
+}
+
+// Validate reports an unknown timeout action
+func (c *Config) Validate() error {
+	switch c.OnTimeout {
+	case "", model.ResolveResume, model.ResolveDrop:
+		return nil
+	default:
+		return fmt.Errorf("unknown timeout action %q, want %s or %s", c.OnTimeout, model.ResolveResume, model.ResolveDrop)
+	}
+}
+
+// State is the rules and the pending breakpoints served to the clients
+type State struct {
+	Rules
+
+	Timeout     string              `json:"timeout"`
+	OnTimeout   string              `json:"on_timeout"`
+	Breakpoints []*model.Breakpoint `json:"breakpoints"`
+}
+
+// Intercept pauses the flows matching its rules until a client resolves them over the control api
+// both hooks run after every other addon, so the edits of a client are what is forwarded or returned
+type Intercept struct {
+	conf   Config
+	sink   capture.Sink
+	logger logrus.FieldLogger
+
+	// breakpoint id -> pending breakpoint
+	mu      sync.Mutex
+	rules   Rules
+	pending map[string]*breakpoint
+	closed  bool
+}
+
+// breakpoint is a paused flow, resolved receives its resolution once
+type breakpoint struct {
+	model.Breakpoint
+
+	resolved chan *model.Resolution
+}
+
+func New(conf *Config, sink capture.Sink, logger logrus.FieldLogger) (*Intercept, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	i := &Intercept{
+		conf:    *conf,
+		sink:    sink,
+		logger:  logger,
+		rules:   conf.Rules,
+		pending: make(map[string]*breakpoint),
+	}
+	if i.conf.Timeout <= 0 {
+		i.conf.Timeout = DefaultTimeout
+	}
+	if len(i.conf.OnTimeout) == 0 {
+		i.conf.OnTimeout = model.ResolveResume
+	}
+
+	return i, nil
+}
+
+// Rules returns the current rules
+func (i *Intercept) Rules() Rules {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.rules
+}
+
+// SetRules replaces the rules, the pending breakpoints stay paused
+func (i *Intercept) SetRules(rules Rules) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.rules = rules
+}
+
+// Breakpoints returns the pending breakpoints, oldest first
+func (i *Intercept) Breakpoints() []*model.Breakpoint {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	breakpoints := make([]*model.Breakpoint, 0, len(i.pending))
+	for _, bp := range i.pending {
+		snapshot := bp.Breakpoint
+		breakpoints = append(breakpoints, &snapshot)
+	}
+	slices.SortFunc(breakpoints, func(a, b *model.Breakpoint) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	return breakpoints
+}
+
+// Resolve resolves the pending breakpoint id
+func (i *Intercept) Resolve(id string, resolution *model.Resolution) error {
+	if err := validateResolution(resolution); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	bp, ok := i.pending[id]
+	if ok {
+		delete(i.pending, id)
+	}
+	i.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending breakpoint %s", id)
+	}
+
+	bp.resolved <- resolution
+	return nil
+}
+
+// Close resolves the pending breakpoints by the timeout policy and stops pausing flows,
+// so shutdown does not wait on abandoned breakpoints
+func (i *Intercept) Close() {
+	i.mu.Lock()
+	pending := i.pending
+	i.pending = make(map[string]*breakpoint)
+	i.closed = true
+	i.mu.Unlock()
+
+	for _, bp := range pending {
+		bp.resolved <- &model.Resolution{Action: i.conf.OnTimeout}
+	}
+}
+
+// RequestAddon returns the addon pausing requests before they are forwarded upstream
+func (i *Intercept) RequestAddon() addon.Addon {
+	return &requestAddon{i: i}
+}
+
+// ResponseAddon returns the addon pausing responses before they are returned to the client
+func (i *Intercept) ResponseAddon() addon.Addon {
+	return &responseAddon{i: i}
+}
+
+type requestAddon struct {
+	addon.Base
+
+	i *Intercept
+}
+
+func (a *requestAddon) Request(r *http.Request) (*http.Response, error) {
+	rule := a.i.Rules().Request
+	if rule.Empty() {
+		return nil, nil
+	}
+
+	flow := &model.PacketCaptureFlow{
+		ID:      addon.FlowID(r),
+		Request: model.NewRequest(r, nil),
+	}
+	body, ok, err := a.i.readBody(rule, flow, &r.Body, r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	flow.Request = model.NewRequest(r, body)
+	if !rule.Match(flow) {
+		return nil, nil
+	}
+
+	resolution, err := a.i.pause(r.Context(), model.BreakpointRequest, flow)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resolution.Action {
+	case model.ResolveDrop:
+		return nil, addon.ErrDrop
+	case model.ResolveRespond:
+		return newResponse(r, resolution), nil
+	}
+
+	if len(resolution.Method) > 0 {
+		r.Method = resolution.Method
+	}
+	if len(resolution.URL) > 0 {
+		// validated by Resolve
+		u, _ := url.Parse(resolution.URL)
+		r.URL, r.Host = u, u.Host
+	}
+	if resolution.Header != nil {
+		r.Header = resolution.Header
+	}
+	if resolution.Body != nil {
+		body = []byte(*resolution.Body)
+		r.ContentLength = int64(len(body))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(r.Header.Get("Content-Length")) > 0 {
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+
+	return nil, nil
+}
+
+type responseAddon struct {
+	addon.Base
+
+	i *Intercept
+}
+
+func (a *responseAddon) Response(r *http.Request, resp *http.Response) (*http.Response, error) {
+	rule := a.i.Rules().Response
+	if rule.Empty() || addon.Streaming(resp) {
+		return resp, nil
+	}
+
+	flow := &model.PacketCaptureFlow{
+		ID:       addon.FlowID(r),
+		Request:  model.NewRequest(r, nil),
+		Response: model.NewResponse(resp, nil),
+	}
+	body, ok, err := a.i.readBody(rule, flow, &resp.Body, r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return resp, nil
+	}
+	flow.Response = model.NewResponse(resp, body)
+	if !rule.Match(flow) {
+		return resp, nil
+	}
+
+	resolution, err := a.i.pause(r.Context(), model.BreakpointResponse, flow)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resolution.Action {
+	case model.ResolveDrop:
+		return nil, addon.ErrDrop
+	case model.ResolveRespond:
+		return newResponse(r, resolution), nil
+	}
+
+	if resolution.StatusCode > 0 {
+		resp.StatusCode = resolution.StatusCode
+		resp.Status = fmt.Sprintf("%d %s", resolution.StatusCode, http.StatusText(resolution.StatusCode))
+	}
+	if resolution.Header != nil {
+		resp.Header = resolution.Header
+	}
+	if resolution.Body != nil {
+		body = []byte(*resolution.Body)
+		resp.ContentLength = int64(len(body))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return resp, nil
+}
+
+// readBody buffers the body of a flow rule may pause and reports whether it may,
+// the rule is matched on the headers first, so other bodies stay streaming,
+// and flows with bodies larger than addon.MaxBodySize are never paused
+func (i *Intercept) readBody(rule *filter.Expr, flow *model.PacketCaptureFlow, body *io.ReadCloser, r *http.Request) ([]byte, bool, error) {
+	if !rule.MayMatch(flow) {
+		return nil, false, nil
+	}
+
+	data, ok, err := addon.ReadBody(body, addon.MaxBodySize)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		i.logger.Warnf("intercept: skip %s %s, body larger than %d bytes", r.Method, r.URL, addon.MaxBodySize)
+	}
+
+	return data, ok, nil
+}
+
+// pause publishes the breakpoint and waits for its resolution,
+// the timeout policy resolves it when nobody does in time and abandoned breakpoints fail with the context error
+func (i *Intercept) pause(ctx context.Context, phase string, flow *model.PacketCaptureFlow) (*model.Resolution, error) {
+	now := time.Now()
+	bp := &breakpoint{
+		Breakpoint: model.Breakpoint{
+			ID:       uuid.NewString(),
+			Phase:    phase,
+			State:    model.BreakpointPaused,
+			Time:     now,
+			Deadline: now.Add(i.conf.Timeout),
+			Flow:     flow,
+		},
+		resolved: make(chan *model.Resolution, 1),
+	}
+
+	i.mu.Lock()
+	if i.closed {
+		i.mu.Unlock()
+		return &model.Resolution{Action: model.ResolveResume}, nil
+	}
+	i.pending[bp.ID] = bp
+	i.mu.Unlock()
+
+	snapshot := bp.Breakpoint
+	i.sink.Publish(model.NewBreakpointEvent(&snapshot))
+	i.logger.Infof("paused %s %s %s at breakpoint %s", phase, flow.Request.Method, flow.Request.Url, bp.ID)
+
+	timer := time.NewTimer(i.conf.Timeout)
+	defer timer.Stop()
+
+	var (
+		resolution *model.Resolution
+		err        error
+	)
+	select {
+	case resolution = <-bp.resolved:
+	case <-timer.C:
+		if !i.remove(bp.ID) {
+			// resolved just now
+			resolution = <-bp.resolved
+			break
+		}
+		resolution = &model.Resolution{Action: i.conf.OnTimeout}
+		bp.TimedOut = true
+		i.logger.Warnf("breakpoint %s timed out, %s", bp.ID, i.conf.OnTimeout)
+	case <-ctx.Done():
+		if !i.remove(bp.ID) {
+			resolution = <-bp.resolved
+			break
+		}
+		err = fmt.Errorf("breakpoint %s abandoned: %w", bp.ID, ctx.Err())
+	}
+
+	if err != nil {
+		bp.State = model.BreakpointAbandoned
+	} else {
+		if len(resolution.Action) == 0 {
+			resolution.Action = model.ResolveResume
+		}
+		bp.State = resolution.Action
+	}
+	snapshot = bp.Breakpoint
+	i.sink.Publish(model.NewBreakpointEvent(&snapshot))
+
+	return resolution, err
+}
+
+// remove removes the pending breakpoint id, reporting whether it was still pending
+func (i *Intercept) remove(id string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	_, ok := i.pending[id]
+	delete(i.pending, id)
+	return ok
+}
+
+// ServeHTTP serves the control api
+//
+//	GET  /intercept       the rules and the pending breakpoints
+//	PUT  /intercept       replaces the rules
+//	POST /intercept/{id}  resolves a pending breakpoint
+func (i *Intercept) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/intercept"), "/")
+	if len(id) > 0 {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var resolution model.Resolution
+		if err := json.NewDecoder(r.Body).Decode(&resolution); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateResolution(&resolution); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := i.Resolve(id, &resolution); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rules Rules
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		i.SetRules(rules)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&State{
+		Rules:       i.Rules(),
+		Timeout:     i.conf.Timeout.String(),
+		OnTimeout:   i.conf.OnTimeout,
+		Breakpoints: i.Breakpoints(),
+	})
+}
+
+// validateResolution reports an unknown action or an invalid edit
+func validateResolution(resolution *model.Resolution) error {
+	switch resolution.Action {
+	case "", model.ResolveResume, model.ResolveDrop, model.ResolveRespond:
+	default:
+		return fmt.Errorf("unknown action %q, want %s, %s or %s", resolution.Action, model.ResolveResume, model.ResolveDrop, model.ResolveRespond)
+	}
+	if len(resolution.URL) > 0 {
+		u, err := url.Parse(resolution.URL)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("invalid url %q, want an absolute url", resolution.URL)
+		}
+	}
+	if resolution.StatusCode != 0 && (resolution.StatusCode < 100 || resolution.StatusCode > 999) {
+		return fmt.Errorf("invalid status code %d", resolution.StatusCode)
+	}
+
+	return nil
+}
+
+// newResponse builds the response a resolution responds with, 200 by default
+func newResponse(r *http.Request, resolution *model.Resolution) *http.Response {
+	code := resolution.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	var body []byte
+	if resolution.Body != nil {
+		body = []byte(*resolution.Body)
+	}
+
+	return addon.NewResponse(r, code, resolution.Header, body)
+}
@@ -0,0 +1,147 @@
+package maplocal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/Twacqwq/mitmfoxy/internal/urlpattern"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/sirupsen/logrus"
+)
+
+// index files looked up in mapped directories, in order
+var indexFiles = []string{"index.html", "index.htm"}
+
+// Rule maps the requests matching URL to a local file or directory
+type Rule struct {
+	// [scheme://]host[:port][/path], the host is a glob and the path a prefix, e.g. *.example.com/static/
+	URL string `json:"url"`
+
+	// a file answering every matching request,
+	// or a directory the path below the url prefix is looked up in, directories answer with their index file
+	Path string `json:"path"`
+
+	// 200 by default, files missing from a mapped directory answer 404
+	Status int `json:"status,omitempty"`
+
+	// set on the response, after the inferred content type
+	Header http.Header `json:"header,omitempty"`
+}
+
+// MapLocal answers the requests matching its rules from disk without contacting upstream
+// files are read on every request, so they can be edited while the proxy runs
+type MapLocal struct {
+	addon.Base
+
+	rules  []*rule
+	logger logrus.FieldLogger
+}
+
+type rule struct {
+	Rule
+
+	pattern *urlpattern.Pattern
+	dir     bool
+}
+
+func New(rules []Rule, logger logrus.FieldLogger) (*MapLocal, error) {
+	m := &MapLocal{logger: logger}
+	for _, r := range rules {
+		pattern, err := urlpattern.Parse(r.URL)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", r.URL, err)
+		}
+		if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+			return nil, fmt.Errorf("map %s: invalid status %d", r.URL, r.Status)
+		}
+		m.rules = append(m.rules, &rule{Rule: r, pattern: pattern, dir: info.IsDir()})
+	}
+
+	return m, nil
+}
+
+// Request answers the request from the first matching rule
+func (m *MapLocal) Request(r *http.Request) (*http.Response, error) {
+	for _, rule := range m.rules {
+		rest, ok := rule.pattern.Match(r.URL)
+		if !ok {
+			continue
+		}
+
+		name := rule.Path
+		if rule.dir {
+			// the cleaned rooted path cannot escape the directory
+			name = filepath.Join(rule.Path, filepath.FromSlash(path.Clean("/"+rest)))
+		}
+		m.logger.Debugf("map local %s to %s", r.URL, name)
+
+		return rule.respond(r, name)
+	}
+
+	return nil, nil
+}
+
+// respond answers r with the file name, or 404 when it is missing
+func (rule *rule) respond(r *http.Request, name string) (*http.Response, error) {
+	data, err := readFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return addon.NewResponse(r, http.StatusNotFound, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, []byte("404 page not found\n")), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("map local: %w", err)
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType(name, data))
+	for k, v := range rule.Header {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return addon.NewResponse(r, status, header, data), nil
+}
+
+// readFile reads name, or the index file of the directory name
+func readFile(name string) ([]byte, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return os.ReadFile(name)
+	}
+
+	for _, index := range indexFiles {
+		data, err := os.ReadFile(filepath.Join(name, index))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+// contentType infers the content type from the extension, then from the content
+func contentType(name string, data []byte) string {
+	if typ := mime.TypeByExtension(filepath.Ext(name)); len(typ) > 0 {
+		return typ
+	}
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return "text/html; charset=utf-8"
+	}
+
+	return http.DetectContentType(data)
+}
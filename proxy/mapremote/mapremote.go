@@ -0,0 +1,126 @@
+package mapremote
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/internal/urlpattern"
+	"github.com/sirupsen/logrus"
+)
+
+// Rule sends the requests matching URL to Target
+type Rule struct {
+	// [scheme://]host[:port][/path], the host is a glob and the path a prefix, e.g. api.example.com/v2/
+	URL string `json:"url"`
+
+	// scheme://host[:port][/path], the path replaces the matched prefix, without a path the request path is kept,
+	// e.g. http://localhost:3000
+	Target string `json:"target"`
+
+	// keep the Host header of the original request instead of the target host
+	PreserveHost bool `json:"preserve_host,omitempty"`
+}
+
+// MapRemote redirects the requests matching its rules to another scheme, host, port or path before they are dialed
+// the client keeps talking to the original origin, absolute redirects to the target are rewritten back to it
+type MapRemote struct {
+	rules  []*rule
+	logger logrus.FieldLogger
+}
+
+type rule struct {
+	Rule
+
+	pattern *urlpattern.Pattern
+	target  *url.URL
+}
+
+func New(rules []Rule, logger logrus.FieldLogger) (*MapRemote, error) {
+	m := &MapRemote{logger: logger}
+	for _, r := range rules {
+		pattern, err := urlpattern.Parse(r.URL)
+		if err != nil {
+			return nil, err
+		}
+		target, err := url.Parse(r.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || len(target.Host) == 0 {
+			return nil, fmt.Errorf("map %s: invalid target %q, want e.g. http://localhost:3000", r.URL, r.Target)
+		}
+		m.rules = append(m.rules, &rule{Rule: r, pattern: pattern, target: target})
+	}
+
+	return m, nil
+}
+
+// Redirects reports whether a rule redirects every https request to hostport
+func (m *MapRemote) Redirects(hostport string) bool {
+	for _, rule := range m.rules {
+		if rule.pattern.MatchesOrigin("https", hostport) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type originKey struct{}
+
+// Request rewrites the url of the request by the first matching rule
+func (m *MapRemote) Request(r *http.Request) (*http.Response, error) {
+	for _, rule := range m.rules {
+		rest, ok := rule.pattern.Match(r.URL)
+		if !ok {
+			continue
+		}
+
+		origin := &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}
+		u := *r.URL
+		u.Scheme, u.Host = rule.target.Scheme, rule.target.Host
+		if len(rule.target.Path) > 0 {
+			u.Path, u.RawPath = joinPath(rule.target.Path, rest), ""
+		}
+		m.logger.Debugf("map remote %s to %s", r.URL, &u)
+
+		r.URL = &u
+		if !rule.PreserveHost {
+			r.Host = u.Host
+		}
+		// the response hook rewrites redirects back to the origin
+		*r = *r.WithContext(context.WithValue(r.Context(), originKey{}, [2]*url.URL{origin, rule.target}))
+
+		return nil, nil
+	}
+
+	return nil, nil
+}
+
+// Response rewrites absolute redirects to the target back to the origin the client requested
+func (m *MapRemote) Response(r *http.Request, resp *http.Response) (*http.Response, error) {
+	mapping, ok := r.Context().Value(originKey{}).([2]*url.URL)
+	location := resp.Header.Get("Location")
+	if !ok || len(location) == 0 {
+		return resp, nil
+	}
+
+	origin, target := mapping[0], mapping[1]
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != target.Scheme || !strings.EqualFold(u.Host, target.Host) {
+		return resp, nil
+	}
+	u.Scheme, u.Host = origin.Scheme, origin.Host
+	resp.Header.Set("Location", u.String())
+
+	return resp, nil
+}
+
+// joinPath appends the path below the matched prefix to the target path
+func joinPath(base, rest string) string {
+	if len(rest) == 0 {
+		return base
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(rest, "/")
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/Twacqwq/mitmfoxy/cert"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/Twacqwq/mitmfoxy/proxy/connection"
+	"github.com/sirupsen/logrus"
+)
+
+// Option configures a Proxy
+type Option func(*Proxy)
+
+// WithListener serves the proxy on ln instead of listening on Config.Addr
+func WithListener(ln net.Listener) Option {
+	return func(p *Proxy) {
+		p.listener = ln
+	}
+}
+
+// WithCertProvider issues intercepted certificates with provider instead of the Config.CertFile root ca
+func WithCertProvider(provider cert.Provider) Option {
+	return func(p *Proxy) {
+		p.certProvider = provider
+	}
+}
+
+// WithDialer dials upstream conns with dialer instead of connecting directly
+func WithDialer(dialer connection.Dialer) Option {
+	return func(p *Proxy) {
+		p.dialer = dialer
+	}
+}
+
+// WithLogger logs with logger instead of the logrus standard logger
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(p *Proxy) {
+		p.logger = logger
+	}
+}
+
+// WithAddons runs addons on every request and response, in order
+func WithAddons(addons ...addon.Addon) Option {
+	return func(p *Proxy) {
+		p.addons = append(p.addons, addons...)
+	}
+}
+
+// WithSinks publishes captured flows and connection events to sinks
+func WithSinks(sinks ...capture.Sink) Option {
+	return func(p *Proxy) {
+		p.sinks = append(p.sinks, sinks...)
+	}
+}
+
+// WithStore keeps the recent flows in store, e.g. to size it or share it with the embedding program
+func WithStore(store *capture.Store) Option {
+	return func(p *Proxy) {
+		p.store = store
+	}
+}
@@ -0,0 +1,222 @@
+package playback
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/sirupsen/logrus"
+)
+
+// unmatched request policies
+const (
+	// answer 404 Not Found
+	UnmatchedNotFound = "404"
+
+	// forward the request upstream
+	UnmatchedPassthrough = "passthrough"
+
+	// fail the flow and log an error, the failures are counted by Unmatched
+	UnmatchedFail = "fail"
+)
+
+// Config holds the matching rules, requests always match on method and url
+type Config struct {
+	// request headers that must match too, e.g. Accept or Authorization
+	Headers []string
+
+	// the request body must match too
+	Body bool
+
+	// query parameters ignored when matching, e.g. cache busters
+	IgnoreQuery []string
+
+	// what to do with requests matching no recorded flow, UnmatchedNotFound by default
+	Unmatched string
+}
+
+// Validate reports an unknown unmatched policy
+func (c *Config) Validate() error {
+	switch c.Unmatched {
+	case "", UnmatchedNotFound, UnmatchedPassthrough, UnmatchedFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown unmatched policy %q, want %s, %s or %s", c.Unmatched, UnmatchedNotFound, UnmatchedPassthrough, UnmatchedFail)
+	}
+}
+
+// Playback answers requests with the responses of recorded flows instead of contacting upstream
+// identical requests are answered in recorded order, the last recorded response repeats once they run out,
+// and a recorded failure is replayed as a failure
+type Playback struct {
+	addon.Base
+
+	conf   Config
+	logger logrus.FieldLogger
+
+	// match key -> recorded flows not yet played
+	mu    sync.Mutex
+	flows map[string][]*model.PacketCaptureFlow
+
+	matched   atomic.Int64
+	unmatched atomic.Int64
+}
+
+func New(flows []*model.PacketCaptureFlow, conf *Config, logger logrus.FieldLogger) (*Playback, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Playback{
+		conf:   *conf,
+		logger: logger,
+		flows:  make(map[string][]*model.PacketCaptureFlow),
+	}
+	if len(p.conf.Unmatched) == 0 {
+		p.conf.Unmatched = UnmatchedNotFound
+	}
+	for i := range p.conf.Headers {
+		p.conf.Headers[i] = http.CanonicalHeaderKey(p.conf.Headers[i])
+	}
+
+	for _, flow := range flows {
+		if flow.Request == nil {
+			continue
+		}
+		u, err := url.Parse(flow.Request.Url)
+		if err != nil {
+			return nil, fmt.Errorf("flow %s: %w", flow.ID, err)
+		}
+		key := p.key(flow.Request.Method, u, flow.Request.Header, flow.Request.Body)
+		p.flows[key] = append(p.flows[key], flow)
+	}
+
+	return p, nil
+}
+
+// Offline reports whether requests never need upstream, i.e. unmatched requests are not passed through
+func (p *Playback) Offline() bool {
+	return p.conf.Unmatched != UnmatchedPassthrough
+}
+
+// Matched returns the number of requests answered from the recording
+func (p *Playback) Matched() int64 {
+	return p.matched.Load()
+}
+
+// Unmatched returns the number of requests that matched no recorded flow
+func (p *Playback) Unmatched() int64 {
+	return p.unmatched.Load()
+}
+
+func (p *Playback) Request(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if p.conf.Body {
+		// the body is kept for the capture and for passthrough
+		var err error
+		if body, _, err = addon.ReadBody(&r.Body, -1); err != nil {
+			return nil, err
+		}
+	}
+
+	flow, ok := p.next(p.key(r.Method, r.URL, r.Header, body))
+	if !ok {
+		return p.unmatchedResponse(r)
+	}
+	p.matched.Add(1)
+
+	if flow.Response == nil {
+		return nil, fmt.Errorf("playback: recorded flow %s failed: %s", flow.ID, flow.Error)
+	}
+
+	return newResponse(r, flow.Response), nil
+}
+
+// next takes the next recorded flow for key, the last one is kept
+func (p *Playback) next(key string) (*model.PacketCaptureFlow, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	flows := p.flows[key]
+	if len(flows) == 0 {
+		return nil, false
+	}
+	if len(flows) > 1 {
+		p.flows[key] = flows[1:]
+	}
+
+	return flows[0], true
+}
+
+func (p *Playback) unmatchedResponse(r *http.Request) (*http.Response, error) {
+	p.unmatched.Add(1)
+
+	switch p.conf.Unmatched {
+	case UnmatchedPassthrough:
+		return nil, nil
+	case UnmatchedFail:
+		err := fmt.Errorf("playback: no recorded flow matches %s %s", r.Method, r.URL)
+		p.logger.Error(err)
+		return nil, err
+	default:
+		body := fmt.Sprintf("no recorded flow matches %s %s\n", r.Method, r.URL)
+		return addon.NewResponse(r, http.StatusNotFound, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, []byte(body)), nil
+	}
+}
+
+// key identifies the requests answered alike
+func (p *Playback) key(method string, u *url.URL, header http.Header, body []byte) string {
+	var b strings.Builder
+	b.WriteString(method)
+	b.WriteByte(' ')
+	b.WriteString(normalizeURL(u, p.conf.IgnoreQuery))
+
+	for _, name := range p.conf.Headers {
+		fmt.Fprintf(&b, "\n%s: %s", name, strings.Join(header.Values(name), ","))
+	}
+	if p.conf.Body {
+		fmt.Fprintf(&b, "\n%x", sha256.Sum256(body))
+	}
+
+	return b.String()
+}
+
+// normalizeURL drops default ports, the fragment and the ignored query parameters, and sorts the query
+func normalizeURL(u *url.URL, ignoreQuery []string) string {
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	if port := u.Port(); len(port) > 0 && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// ipv6 literals keep their brackets
+		host = "[" + host + "]"
+	}
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	query := u.Query()
+	for _, name := range ignoreQuery {
+		query.Del(name)
+	}
+
+	// Encode sorts by name, values keep their order
+	return scheme + "://" + host + path + "?" + query.Encode()
+}
+
+// newResponse builds the response to r from a recorded one, the body is played as recorded on the wire
+func newResponse(r *http.Request, recorded *model.Response) *http.Response {
+	resp := addon.NewResponse(r, recorded.StatusCode, recorded.Header.Clone(), recorded.Body)
+	if len(recorded.StatusText) > 0 {
+		resp.Status = fmt.Sprintf("%d %s", recorded.StatusCode, recorded.StatusText)
+	}
+
+	return resp
+}
@@ -0,0 +1,187 @@
+package playback
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url         string
+		ignoreQuery []string
+		want        string
+	}{
+		{"http://Example.com", nil, "http://example.com/?"},
+		{"http://example.com:80/a", nil, "http://example.com/a?"},
+		{"https://example.com:443/a", nil, "https://example.com/a?"},
+		{"http://example.com:443/a", nil, "http://example.com:443/a?"},
+		{"https://example.com:8443/a#frag", nil, "https://example.com:8443/a?"},
+		{"https://[::1]:443/a", nil, "https://[::1]/a?"},
+		{"https://[::1]/a", nil, "https://[::1]/a?"},
+		{"http://[::1]:8080/a", nil, "http://[::1]:8080/a?"},
+		{"http://example.com/a?b=2&a=1&a=0", nil, "http://example.com/a?a=1&a=0&b=2"},
+		{"http://example.com/a?b=2&ts=1&a=1", []string{"ts"}, "http://example.com/a?a=1&b=2"},
+		{"http://example.com/a%2Fb", nil, "http://example.com/a%2Fb?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := normalizeURL(u, tt.ignoreQuery); got != tt.want {
+				t.Errorf("normalizeURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+// recorded returns a flow of method and url answered with status and body
+func recorded(id, method, rawURL string, header http.Header, reqBody string, status int, body string) *model.PacketCaptureFlow {
+	return &model.PacketCaptureFlow{
+		ID:       id,
+		Request:  &model.Request{Method: method, Url: rawURL, Header: header, Body: []byte(reqBody)},
+		Response: &model.Response{StatusCode: status, Header: http.Header{}, Body: []byte(body)},
+	}
+}
+
+func TestRequestMatching(t *testing.T) {
+	flows := []*model.PacketCaptureFlow{
+		recorded("get", http.MethodGet, "https://example.com/a?b=2&a=1", nil, "", 200, "get"),
+		recorded("post", http.MethodPost, "https://example.com/a?a=1&b=2", nil, "", 201, "post"),
+		recorded("json", http.MethodGet, "https://example.com/h", http.Header{"Accept": {"application/json"}}, "", 200, "json"),
+		recorded("html", http.MethodGet, "https://example.com/h", http.Header{"Accept": {"text/html"}}, "", 200, "html"),
+		recorded("one", http.MethodPost, "https://example.com/b", nil, "1", 200, "one"),
+		recorded("two", http.MethodPost, "https://example.com/b", nil, "2", 200, "two"),
+	}
+	conf := &Config{Headers: []string{"accept"}, Body: true, IgnoreQuery: []string{"ts"}}
+	p, err := New(flows, conf, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, url string
+		header      http.Header
+		body        string
+		want        string
+	}{
+		{http.MethodGet, "https://example.com:443/a?a=1&b=2&ts=9", nil, "", "get"},
+		{http.MethodPost, "https://EXAMPLE.com/a?b=2&a=1", nil, "", "post"},
+		{http.MethodGet, "https://example.com/a?a=1", nil, "", ""},
+		{http.MethodGet, "http://example.com/a?a=1&b=2", nil, "", ""},
+		{http.MethodGet, "https://example.com/h", http.Header{"Accept": {"text/html"}}, "", "html"},
+		{http.MethodGet, "https://example.com/h", http.Header{"Accept": {"application/json"}}, "", "json"},
+		{http.MethodGet, "https://example.com/h", nil, "", ""},
+		{http.MethodPost, "https://example.com/b", nil, "2", "two"},
+		{http.MethodPost, "https://example.com/b", nil, "1", "one"},
+		{http.MethodPost, "https://example.com/b", nil, "3", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		maps.Copy(r.Header, tt.header)
+		resp, err := p.Request(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if tt.want == "" {
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s answered %d %q, want unmatched", tt.method, tt.url, resp.StatusCode, body)
+			}
+			continue
+		}
+		if string(body) != tt.want {
+			t.Errorf("%s %s answered %q, want %q", tt.method, tt.url, body, tt.want)
+		}
+		// the body is still readable for the capture
+		if data, _ := io.ReadAll(r.Body); string(data) != tt.body {
+			t.Errorf("%s %s request body = %q after matching, want %q", tt.method, tt.url, data, tt.body)
+		}
+	}
+
+	if p.Matched() != 6 || p.Unmatched() != 4 {
+		t.Errorf("matched %d, unmatched %d, want 6 and 4", p.Matched(), p.Unmatched())
+	}
+}
+
+func TestRequestOrder(t *testing.T) {
+	flows := []*model.PacketCaptureFlow{
+		recorded("1", http.MethodGet, "https://example.com/", nil, "", 200, "1"),
+		recorded("2", http.MethodGet, "https://example.com/", nil, "", 200, "2"),
+		{ID: "3", Request: &model.Request{Method: http.MethodGet, Url: "https://example.com/"}, Error: "refused"},
+	}
+	p, err := New(flows, &Config{}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{"1", "2", "", ""} {
+		resp, err := p.Request(httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+		if want == "" {
+			// the recorded failure repeats as the last flow
+			if err == nil || !strings.Contains(err.Error(), "refused") {
+				t.Errorf("request %d error = %v, want the recorded failure", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != want {
+			t.Errorf("request %d answered %q, want %q", i, body, want)
+		}
+	}
+}
+
+func TestUnmatched(t *testing.T) {
+	tests := []struct {
+		policy  string
+		status  int
+		wantErr bool
+	}{
+		{"", http.StatusNotFound, false},
+		{UnmatchedNotFound, http.StatusNotFound, false},
+		{UnmatchedPassthrough, 0, false},
+		{UnmatchedFail, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			p, err := New(nil, &Config{Unmatched: tt.policy}, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := p.Request(httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			status := 0
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d, 0 meaning no response", status, tt.status)
+			}
+			if p.Offline() != (tt.policy != UnmatchedPassthrough) {
+				t.Errorf("Offline() = %v", p.Offline())
+			}
+		})
+	}
+
+	if _, err := New(nil, &Config{Unmatched: "drop"}, logrus.New()); err == nil {
+		t.Error("New accepted an unknown unmatched policy")
+	}
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/Twacqwq/mitmfoxy/proxy/connection"
+	"github.com/google/uuid"
+)
+
+// exchange forwards r upstream through rt and copies the response to w,
+// addons may answer or alter the exchange and the progress of the flow is published to the sink.
+// serverConn identifies the upstream conn unless rt reports a pooled one
+func (o *Options) exchange(w http.ResponseWriter, r *http.Request, rt http.RoundTripper, timing model.Timing, clientConn, serverConn *model.ConnInfo) error {
+	timing.RequestStart = time.Now()
+
+	// the hooks see the id the flow is captured under
+	id := uuid.NewString()
+	r = r.WithContext(addon.WithFlowID(r.Context(), id))
+
+	resp, err := o.Addons.Request(r)
+	flow := model.NewPacketCaptureFlow(r, clientConn)
+	flow.ID = id
+	if err != nil {
+		o.fail(flow, &timing, err)
+		abort(r, err)
+		return err
+	}
+	o.publish(model.EventRequestStarted, flow)
+
+	var reqBuf bytes.Buffer
+	if resp == nil {
+		ctx := connection.WithRequestTrace(r.Context(), &timing)
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if c, ok := info.Conn.(*connection.ProxyServerConn); ok {
+					serverConn = c.Info()
+				}
+			},
+		})
+
+		reqBody := io.TeeReader(r.Body, &reqBuf)
+		proxyReq, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), reqBody)
+		if err != nil {
+			o.fail(flow, &timing, err)
+			return err
+		}
+		proxyReq.Header = r.Header
+		// an addon may have sent the request elsewhere and kept the host
+		proxyReq.Host = r.Host
+		proxyReq.ContentLength = r.ContentLength
+		if r.ContentLength == 0 {
+			proxyReq.Body = http.NoBody
+		}
+
+		if resp, err = rt.RoundTrip(proxyReq); err != nil {
+			flow.Request = model.NewRequest(r, reqBuf.Bytes())
+			o.fail(flow, &timing, err)
+			return err
+		}
+		flow.ServerConn = serverConn
+	} else {
+		// answered by an addon, keep the request body for the flow
+		io.Copy(&reqBuf, r.Body)
+	}
+	defer resp.Body.Close()
+	flow.Request = model.NewRequest(r, reqBuf.Bytes())
+
+	// addons may replace the upstream response
+	if resp, err = o.Addons.Response(r, resp); err != nil {
+		o.fail(flow, &timing, err)
+		abort(r, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	flow.Response = model.NewResponse(resp, nil)
+	o.publish(model.EventResponseHeaders, flow)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return o.tunnelWebSocket(w, resp, flow, &timing)
+	}
+
+	var respBuf bytes.Buffer
+	respBody := io.TeeReader(resp.Body, &respBuf)
+
+	// copy response header to writer
+	maps.Copy(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err = io.Copy(w, respBody); err != nil {
+		flow.Response = model.NewResponse(resp, respBuf.Bytes())
+		o.fail(flow, &timing, err)
+		return sentError{err}
+	}
+	timing.ResponseComplete = time.Now()
+
+	flow.Response = model.NewResponse(resp, respBuf.Bytes())
+	flow.Timing = &timing
+	o.publish(model.EventResponseComplete, flow)
+
+	return nil
+}
+
+// sentError is an exchange error once the response headers were sent, no error response can follow it
+type sentError struct{ error }
+
+func (e sentError) Unwrap() error {
+	return e.error
+}
+
+// ResponseSent reports whether err occurred once the response headers were sent
+func ResponseSent(err error) bool {
+	var sent sentError
+	return errors.As(err, &sent)
+}
+
+// abort closes the client conn without a response when a hook dropped or reset the flow,
+// the server recovers http.ErrAbortHandler silently
+func abort(r *http.Request, err error) {
+	switch {
+	case errors.Is(err, addon.ErrReset):
+		if enhancedConn, err := connection.GetEnhancedConnFromContext(r.Context()); err == nil {
+			enhancedConn.Reset()
+		}
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, addon.ErrDrop):
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// publish publishes a snapshot of the flow as it is now
+func (o *Options) publish(typ string, flow *model.PacketCaptureFlow) {
+	o.Sink.Publish(model.NewFlowEvent(typ, flow.Snapshot()))
+}
+
+// fail publishes the flow as failed with err
+func (o *Options) fail(flow *model.PacketCaptureFlow, timing *model.Timing, err error) {
+	flow.Error = err.Error()
+	flow.Timing = timing
+	o.publish(model.EventFlowError, flow)
+}
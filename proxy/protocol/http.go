@@ -1,66 +1,46 @@
 package protocol
 
 import (
-	"bytes"
-	"io"
-	"maps"
+	"context"
 	"net/http"
 
-	"github.com/Twacqwq/mitmfoxy/internal/model"
 	"github.com/Twacqwq/mitmfoxy/proxy/connection"
 )
 
 // HTTPHandler is a handler for HTTP protocol
 type httpHandler struct {
-	pcw *PacketCaptureWebSocket
+	*Options
+
+	// pooled upstream transport shared by all client conns
+	// idle conns are keyed by destination, the upstream proxy is resolved per destination by the dialer
+	transport *http.Transport
 }
 
 func (h *httpHandler) Handle(w http.ResponseWriter, r *http.Request, enhancedConn *connection.EnhancedConn) error {
-	ServerConn, err := enhancedConn.Session.Dialer.Dial(r.Context(), r)
-	if err != nil {
-		return err
-	}
-	enhancedConn.Session.ServerConn = connection.NewProxyServerConn(ServerConn)
-
-	var reqBuf bytes.Buffer
-	reqBody := io.TeeReader(r.Body, &reqBuf)
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), reqBody)
-	if err != nil {
-		return err
-	}
-	proxyReq.Header = r.Header
-
-	proxyResp, err := enhancedConn.Session.ServerConn.Client.Do(proxyReq)
-	if err != nil {
-		return err
-	}
-	defer proxyResp.Body.Close()
-
-	var respBuf bytes.Buffer
-	respBody := io.TeeReader(proxyResp.Body, &respBuf)
-
-	// copy response header to writer
-	maps.Copy(w.Header(), proxyResp.Header)
-	w.WriteHeader(proxyResp.StatusCode)
+	// connection level phases are only recorded when the pool dials
+	timing := enhancedConn.Session.Timing
+	timing.Reused()
 
-	_, err = io.Copy(w, respBody)
-	if err != nil {
-		return err
+	var rt http.RoundTripper = h.transport
+	if h.Offline {
+		rt = offlineTransport{}
 	}
 
-	go func() {
-		if !h.pcw.enabled {
-			return
-		}
-		flow := model.BuildPacketCaptureFlow(proxyResp, r, &reqBuf, &respBuf)
-		h.pcw.BroadcastJSON(flow)
-	}()
+	return h.exchange(w, r, rt, timing, enhancedConn.Session.ClientConn.Info(), nil)
+}
 
+// Shutdown closes the idle pooled upstream conns
+// in-flight requests are drained by the proxy server
+func (h *httpHandler) Shutdown(ctx context.Context) error {
+	h.transport.CloseIdleConnections()
 	return nil
 }
 
-func NewHTTPHandler(pcw *PacketCaptureWebSocket) Handler {
-	return &httpHandler{
-		pcw: pcw,
+func NewHTTPHandler(opts *Options) Handler {
+	h := &httpHandler{
+		Options: opts,
 	}
+	h.transport = newUpstreamTransport()
+
+	return h
 }
@@ -1,9 +1,18 @@
 package protocol
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
 	"github.com/Twacqwq/mitmfoxy/proxy/connection"
+	"github.com/sirupsen/logrus"
 )
 
 // Handler is the interface that wraps the Handle method.
@@ -12,3 +21,76 @@ type Handler interface {
 	// The enhancedConn contains connection-specific data.
 	Handle(w http.ResponseWriter, r *http.Request, enhancedConn *connection.EnhancedConn) error
 }
+
+// Shutdowner is implemented by handlers holding resources that must be released when the proxy stops
+type Shutdowner interface {
+	// Shutdown waits for in-flight requests until ctx is done and releases the handler resources.
+	Shutdown(ctx context.Context) error
+}
+
+// upstream pool limits
+const (
+	maxIdleConns          = 256
+	maxIdleConnsPerHost   = 16
+	idleConnTimeout       = 90 * time.Second
+	expectContinueTimeout = 1 * time.Second
+)
+
+// Options holds the dependencies shared by protocol handlers
+type Options struct {
+	// logger for protocol errors
+	Logger logrus.FieldLogger
+
+	// receives the captured flows
+	Sink capture.Sink
+
+	// run on every request and response
+	Addons addon.Chain
+
+	// never contact upstream, requests must be answered by the addons
+	Offline bool
+}
+
+// ErrOffline fails the requests left to upstream while offline
+var ErrOffline = errors.New("upstream is offline, no addon answered the request")
+
+// offlineTransport fails every request
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, ErrOffline
+}
+
+// newUpstreamTransport returns a pooled transport dialing with the dialer of the session in the request context,
+// upstream certificates are not verified, like in intercepted tunnels
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:           dialUpstream,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		ExpectContinueTimeout: expectContinueTimeout,
+		DisableCompression:    true,
+	}
+}
+
+// dialUpstream dials pooled upstream conns with the dialer of the session that needs one
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	enhancedConn, err := connection.GetEnhancedConnFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		URL:  &url.URL{Scheme: "http", Host: addr},
+		Host: addr,
+	}
+	c, err := enhancedConn.Session.Dialer.Dial(ctx, r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return enhancedConn.Session.NewServerConn(c), nil
+}
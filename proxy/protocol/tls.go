@@ -1,28 +1,40 @@
 package protocol
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"io"
-	"maps"
+	"errors"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/Twacqwq/mitmfoxy/internal/cert"
-	"github.com/Twacqwq/mitmfoxy/internal/model"
+	"github.com/Twacqwq/mitmfoxy/cert"
+	"github.com/Twacqwq/mitmfoxy/internal/netutil"
+	"github.com/Twacqwq/mitmfoxy/model"
 	"github.com/Twacqwq/mitmfoxy/proxy/connection"
-	"github.com/sirupsen/logrus"
 )
 
 type tlsHandler struct {
-	server      *http.Server
-	tlsListener *tlsListener
-	certManager *cert.Manager
-	pcw         *PacketCaptureWebSocket
+	*Options
+
+	server       *http.Server
+	certProvider cert.Provider
+
+	// pooled transport for the requests an addon redirected away from the origin of their tunnel
+	transport *http.Transport
+
+	// canceled when the handler shuts down
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (t *tlsHandler) Handle(w http.ResponseWriter, r *http.Request, enhancedConn *connection.EnhancedConn) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(t.ctx, cancel)()
+
 	// 200 Connection Established
 	w.WriteHeader(http.StatusOK)
 	hijackConn, _, err := w.(http.Hijacker).Hijack()
@@ -30,20 +42,59 @@ func (t *tlsHandler) Handle(w http.ResponseWriter, r *http.Request, enhancedConn
 		return err
 	}
 
-	serverConn, err := enhancedConn.Session.Dialer.Dial(r.Context(), r)
-	if err != nil {
-		return err
+	// offline tunnels and tunnels whose requests are all redirected are terminated by the proxy alone
+	if !t.Offline && !t.Addons.Redirects(r.Host) {
+		// the tunnel conn is dialed before its requests are served, so its phases go to the session timing
+		// the first flow copies, pooled conns record theirs on the timing of the request dialing them
+		serverConn, err := enhancedConn.Session.Dialer.Dial(connection.WithDialTrace(ctx, &enhancedConn.Session.Timing), r)
+		if err != nil {
+			hijackConn.Close()
+			return err
+		}
+		enhancedConn.Session.SetServerConn(serverConn)
 	}
-	enhancedConn.Session.ServerConn = connection.NewProxyServerConn(serverConn)
 
 	// tls handshake
-	if err := t.Handshake(context.Background(), hijackConn, enhancedConn); err != nil {
-		logrus.Error(err)
+	if err := t.Handshake(ctx, hijackConn, enhancedConn); err != nil {
+		t.Logger.Error(err)
+		hijackConn.Close()
 		return err
 	}
 
 	// Forward traffic
-	t.tlsListener.forward(&forwardConn{enhancedConn.Session.ClientConn.TlsConn, enhancedConn})
+	return t.serve(&forwardConn{Conn: enhancedConn.Session.ClientConn.TlsConn, enhancedConn: enhancedConn})
+}
+
+// serve serves the intercepted conn on the internal server and returns once it is closed
+func (t *tlsHandler) serve(conn *forwardConn) error {
+	ln := newConnListener(conn)
+	conn.done = ln.Close
+
+	err := t.server.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		// shutting down, an accepted conn is drained by the server
+		if !ln.accepted() {
+			conn.Close()
+		}
+		return nil
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown gracefully shuts down the internal server, waiting for in-flight requests until ctx is done
+// remaining conns are closed when ctx expires
+func (t *tlsHandler) Shutdown(ctx context.Context) error {
+	t.cancel()
+	t.transport.CloseIdleConnections()
+	if err := t.server.Shutdown(ctx); err != nil {
+		t.server.Close()
+		return err
+	}
+
 	return nil
 }
 
@@ -52,6 +103,9 @@ func (t *tlsHandler) Handshake(ctx context.Context, hijackConn net.Conn, enhance
 		SessionTicketsDisabled: true,
 		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
 			enhancedConn.Session.ClientConn.ClientHelloInfo = chi
+			if enhancedConn.Session.ServerConn == nil {
+				return t.clientTLSConfig(chi, []string{"http/1.1"})
+			}
 
 			var nextProtocols []string
 			chErr := make(chan error, 1)
@@ -59,7 +113,7 @@ func (t *tlsHandler) Handshake(ctx context.Context, hijackConn net.Conn, enhance
 
 			go func() {
 				if err := t.tlsServerHandshake(ctx, enhancedConn, chState); err != nil {
-					logrus.Error(err)
+					t.Logger.Error(err)
 					chErr <- err
 					return
 				}
@@ -77,31 +131,40 @@ func (t *tlsHandler) Handshake(ctx context.Context, hijackConn net.Conn, enhance
 			close(chState)
 			close(chErr)
 
-			logrus.Infof("SNI: %s", chi.ServerName)
-			c, err := t.certManager.GetCert(chi.ServerName)
-			if err != nil {
-				logrus.Errorf("get cert error: %v", err)
-				return nil, err
-			}
-
-			return &tls.Config{
-				SessionTicketsDisabled: true,
-				Certificates:           []tls.Certificate{*c},
-				NextProtos:             nextProtocols,
-			}, nil
+			return t.clientTLSConfig(chi, nextProtocols)
 		},
 	})
 
 	// tls client handshake
+	handshakeStart := time.Now()
 	if err := clientTlsConn.HandshakeContext(ctx); err != nil {
-		logrus.Errorf("tls handshake error: %v", err)
+		t.Logger.Errorf("tls handshake error: %v", err)
 		return err
 	}
 	enhancedConn.Session.ClientConn.TlsConn = clientTlsConn
+	enhancedConn.Session.ClientConn.IsTLS = true
+	enhancedConn.Session.Timing.ClientTLS = time.Since(handshakeStart) - enhancedConn.Session.Timing.UpstreamTLS
+	enhancedConn.Session.Emit(enhancedConn.Session.ClientConn.Event(model.ConnTLSEstablished))
 
 	return nil
 }
 
+// clientTLSConfig presents a certificate for the requested server name
+func (t *tlsHandler) clientTLSConfig(chi *tls.ClientHelloInfo, nextProtocols []string) (*tls.Config, error) {
+	t.Logger.Infof("SNI: %s", chi.ServerName)
+	c, err := t.certProvider.GetCert(chi.ServerName)
+	if err != nil {
+		t.Logger.Errorf("get cert error: %v", err)
+		return nil, err
+	}
+
+	return &tls.Config{
+		SessionTicketsDisabled: true,
+		Certificates:           []tls.Certificate{*c},
+		NextProtos:             nextProtocols,
+	}, nil
+}
+
 func (t *tlsHandler) tlsServerHandshake(ctx context.Context, enhancedConn *connection.EnhancedConn, chState chan *tls.ConnectionState) error {
 	chi := enhancedConn.Session.ClientConn.ClientHelloInfo
 	tlsConfig := &tls.Config{
@@ -123,10 +186,16 @@ func (t *tlsHandler) tlsServerHandshake(ctx context.Context, enhancedConn *conne
 		}
 	}
 
+	handshakeStart := time.Now()
 	enhancedConn.Session.ServerConn.TlsConn = tls.Client(enhancedConn.Session.ServerConn.Conn, tlsConfig)
 	if err := enhancedConn.Session.ServerConn.TlsConn.HandshakeContext(ctx); err != nil {
 		return err
 	}
+	enhancedConn.Session.Timing.UpstreamTLS = time.Since(handshakeStart)
+
+	tlsState := enhancedConn.Session.ServerConn.TlsConn.ConnectionState()
+	enhancedConn.Session.ServerConn.TlsConnState = &tlsState
+	enhancedConn.Session.Emit(enhancedConn.Session.ServerConn.Event(model.ConnTLSEstablished))
 
 	enhancedConn.Session.ServerConn.Client = &http.Client{
 		Transport: &http.Transport{
@@ -141,7 +210,6 @@ func (t *tlsHandler) tlsServerHandshake(ctx context.Context, enhancedConn *conne
 		},
 	}
 
-	tlsState := enhancedConn.Session.ServerConn.TlsConn.ConnectionState()
 	chState <- &tlsState
 	return nil
 }
@@ -160,89 +228,138 @@ func (t *tlsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.Scheme = "https"
 	}
 
-	var reqBuf bytes.Buffer
-	reqBody := io.TeeReader(r.Body, &reqBuf)
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), reqBody)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	session := traceConn.enhancedConn.Session
+	timing := session.Timing
+	if traceConn.requests.Add(1) > 1 {
+		timing.Reused()
 	}
-	proxyReq.Header = r.Header
 
-	proxyResp, err := traceConn.enhancedConn.Session.ServerConn.Client.Do(proxyReq)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	rt := &tunnelTransport{
+		origin:   netutil.JoinHostPort(r.URL),
+		upstream: t.transport,
 	}
-	defer proxyResp.Body.Close()
-
-	var respBuf bytes.Buffer
-	respBody := io.TeeReader(proxyResp.Body, &respBuf)
-
-	// copy response header to writer
-	maps.Copy(w.Header(), proxyResp.Header)
-	w.WriteHeader(proxyResp.StatusCode)
-
-	_, err = io.Copy(w, respBody)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if t.Offline {
+		rt.upstream = offlineTransport{}
+	}
+	var serverConn *model.ConnInfo
+	if session.ServerConn != nil {
+		rt.tunnel, serverConn = session.ServerConn.Client.Transport, session.ServerConn.Info()
 	}
+	// the pooled transport dials with the session dialer
+	r = r.WithContext(context.WithValue(r.Context(), connection.EnhancedConnContextKey, traceConn.enhancedConn))
 
-	go func() {
-		if !t.pcw.enabled {
-			return
+	if err := t.exchange(w, r, rt, timing, session.ClientConn.Info(), serverConn); err != nil {
+		t.Logger.Error(err)
+		if !ResponseSent(err) {
+			w.WriteHeader(http.StatusInternalServerError)
 		}
-		flow := model.BuildPacketCaptureFlow(proxyResp, r, &reqBuf, &respBuf)
-		t.pcw.BroadcastJSON(flow)
-	}()
+	}
 }
 
-func NewTLSHandler(certManager *cert.Manager, pcw *PacketCaptureWebSocket) Handler {
+func NewTLSHandler(certProvider cert.Provider, opts *Options) Handler {
 	handler := &tlsHandler{
-		tlsListener: &tlsListener{
-			chConn: make(chan net.Conn),
-		},
-		certManager: certManager,
-		pcw:         pcw,
+		Options:      opts,
+		certProvider: certProvider,
+		transport:    newUpstreamTransport(),
 	}
+	handler.ctx, handler.cancel = context.WithCancel(context.Background())
 	handler.server = &http.Server{
 		Handler: handler,
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			return context.WithValue(ctx, connection.TLSConnContextKey, c)
 		},
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state != http.StateClosed && state != http.StateHijacked {
+				return
+			}
+			if fc, ok := c.(*forwardConn); ok {
+				fc.done()
+			}
+		},
 	}
 
-	go func() {
-		logrus.Infof("tls server started")
-		if err := handler.server.Serve(handler.tlsListener); err != nil {
-			logrus.Errorf("tls server error: %v", err)
-			return
-		}
-	}()
-
 	return handler
 }
 
-type tlsListener struct {
-	net.Listener
+// tunnelTransport sends the requests for the origin of a tunnel over its upstream conn,
+// and the requests an addon redirected elsewhere, or all of them when the tunnel was not dialed, over upstream
+type tunnelTransport struct {
+	// host:port the client opened the tunnel to
+	origin string
 
-	chConn chan net.Conn
+	// nil when the tunnel was not dialed
+	tunnel http.RoundTripper
+
+	upstream http.RoundTripper
 }
 
-func (t *tlsListener) Accept() (net.Conn, error) {
-	return <-t.chConn, nil
+func (t *tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.tunnel != nil && req.URL.Scheme == "https" && netutil.JoinHostPort(req.URL) == t.origin {
+		return t.tunnel.RoundTrip(req)
+	}
+
+	return t.upstream.RoundTrip(req)
 }
 
-func (t *tlsListener) forward(conn net.Conn) {
-	t.chConn <- conn
+// connListener is a listener that accepts a single conn
+// it blocks further accepts until closed so the server keeps tracking the conn
+type connListener struct {
+	conn      net.Conn
+	chConn    chan net.Conn
+	chClosed  chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(c net.Conn) *connListener {
+	ln := &connListener{
+		conn:     c,
+		chConn:   make(chan net.Conn, 1),
+		chClosed: make(chan struct{}),
+	}
+	ln.chConn <- c
+
+	return ln
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.chClosed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case c := <-l.chConn:
+		return c, nil
+	case <-l.chClosed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.chClosed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// accepted reports whether the conn was handed to the server
+func (l *connListener) accepted() bool {
+	return len(l.chConn) == 0
 }
 
 type forwardConn struct {
 	net.Conn
 
 	enhancedConn *connection.EnhancedConn
+
+	// number of requests served over the tunnel
+	requests atomic.Int64
+
+	// releases the listener serving the conn
+	done func() error
 }
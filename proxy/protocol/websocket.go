@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// max payload bytes captured per websocket frame, the whole frame is always relayed
+const maxFramePayload = 64 << 10
+
+// websocket opcode names
+var opcodes = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+// tunnelWebSocket relays an upgraded websocket between the client and upstream and publishes its frames
+// the flow completes once either side closes
+func (o *Options) tunnelWebSocket(w http.ResponseWriter, resp *http.Response, flow *model.PacketCaptureFlow, timing *model.Timing) error {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		err := errors.New("upgrade response body is not writable")
+		o.fail(flow, timing, err)
+		return err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := errors.New("client conn can not be upgraded")
+		o.fail(flow, timing, err)
+		return err
+	}
+	clientConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		o.fail(flow, timing, err)
+		return err
+	}
+	defer clientConn.Close()
+
+	// 101 Switching Protocols
+	fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		o.fail(flow, timing, err)
+		return sentError{err}
+	}
+
+	chErr := make(chan error, 2)
+	go func() {
+		chErr <- o.relayFrames(upstream, rw.Reader, flow.ID, true)
+	}()
+	go func() {
+		chErr <- o.relayFrames(clientConn, upstream, flow.ID, false)
+	}()
+
+	// either side going away ends both directions
+	<-chErr
+	clientConn.Close()
+	upstream.Close()
+	<-chErr
+
+	timing.ResponseComplete = time.Now()
+	flow.Timing = timing
+	o.publish(model.EventResponseComplete, flow)
+
+	return nil
+}
+
+// relayFrames copies websocket frames from src to dst, publishing each of them
+func (o *Options) relayFrames(dst io.Writer, src io.Reader, flowID string, fromClient bool) error {
+	var header [14]byte
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+
+		n := 2
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(header[n:]))
+			n += 8
+		}
+
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return err
+			}
+			mask = header[n : n+4]
+			n += 4
+		}
+
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+
+		payload := &headWriter{max: maxFramePayload}
+		if _, err := io.CopyN(io.MultiWriter(dst, payload), src, length); err != nil {
+			return err
+		}
+
+		data := payload.buf.Bytes()
+		for i := range data {
+			if masked {
+				data[i] ^= mask[i%4]
+			}
+		}
+
+		name, ok := opcodes[opcode]
+		if !ok {
+			name = fmt.Sprintf("unknown(%d)", opcode)
+		}
+		o.Sink.Publish(model.NewWebSocketEvent(&model.WebSocketMessage{
+			FlowID:     flowID,
+			FromClient: fromClient,
+			Opcode:     name,
+			Fin:        fin,
+			Payload:    data,
+			Length:     length,
+		}))
+	}
+}
+
+// headWriter keeps the first max bytes written to it and discards the rest
+type headWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.max - h.buf.Len(); room > 0 {
+		h.buf.Write(p[:min(room, len(p))])
+	}
+
+	return len(p), nil
+}
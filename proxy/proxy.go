@@ -3,15 +3,24 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"sync"
 	"time"
 
-	"github.com/Twacqwq/mitmfoxy/internal/cert"
+	"github.com/Twacqwq/mitmfoxy/cert"
 	"github.com/Twacqwq/mitmfoxy/internal/netutil"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
 	"github.com/Twacqwq/mitmfoxy/proxy/connection"
+	"github.com/Twacqwq/mitmfoxy/proxy/intercept"
 	"github.com/Twacqwq/mitmfoxy/proxy/protocol"
+	"github.com/Twacqwq/mitmfoxy/proxy/replay"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,49 +36,189 @@ type Config struct {
 
 	// use websocket to recv packet capture
 	UseWebsocket bool
+
+	// serve the capture endpoints on this loopback addr instead of the proxy port
+	ControlAddr string
+
+	// token capture clients must present, generated when empty
+	CaptureToken string
+
+	// origins browsers may open capture clients from, besides the capture endpoint itself
+	AllowedOrigins []string
+
+	// never contact upstream, requests must be answered by the addons, e.g. in playback
+	Offline bool
+
+	// breakpoint rules and timeout policy, the rules can be changed over the control api
+	Intercept intercept.Config
 }
 
-type proxy struct {
+// Proxy is a mitm proxy server
+type Proxy struct {
 	// proxy server
 	server *http.Server
 
+	// listener the server is bound to, nil until Listen
+	listener net.Listener
+
+	// issues the certificates presented to intercepted clients
+	certProvider cert.Provider
+
+	// dials upstream conns
+	dialer connection.Dialer
+
+	logger logrus.FieldLogger
+
+	// run on every request and response
+	addons addon.Chain
+
+	// receive captured flows and connection events
+	sinks capture.Sinks
+
+	// keeps the recent flows
+	store *capture.Store
+
+	// fans captured flows out to the capture clients
+	hub *capture.Hub
+
+	// packet capture websocket
+	pcw *capture.PacketCaptureWebSocket
+
+	// packet capture event streams
+	pcs *capture.PacketCaptureStream
+
+	// guards the capture endpoints
+	access *capture.Access
+
+	// sends captured requests again
+	replayer *replay.Replayer
+
+	// pauses flows at breakpoints
+	intercept *intercept.Intercept
+
+	// token was generated rather than configured
+	generatedToken bool
+
+	// serves the capture endpoints on their own listener, nil when they share the proxy port
+	control         *http.Server
+	controlListener net.Listener
+
 	// protocol handler map
 	// scheme -> protocol.handler
 	// e.g http -> http handler
 	protocols map[string]protocol.Handler
+
+	// open client conns, including hijacked tunnels the server no longer tracks
+	// client conn id -> enhanced conn
+	mu    sync.Mutex
+	conns map[string]*connection.EnhancedConn
 }
 
-func New(conf *Config) *proxy {
-	p := &proxy{
-		server: &http.Server{
-			Addr: conf.Addr,
-			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-				enhancedConn := connection.NewEnhancedConn(c)
-				return context.WithValue(ctx, connection.EnhancedConnContextKey, enhancedConn)
-			},
-		},
+func New(conf *Config, opts ...Option) *Proxy {
+	p := &Proxy{
 		protocols: make(map[string]protocol.Handler),
+		conns:     make(map[string]*connection.EnhancedConn),
+	}
+	p.server = &http.Server{
+		Addr: conf.Addr,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			enhancedConn, ok := c.(*connection.EnhancedConn)
+			if !ok {
+				enhancedConn = connection.NewEnhancedConn(c, p.emitConnEvent)
+			}
+			return context.WithValue(ctx, connection.EnhancedConnContextKey, enhancedConn)
+		},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.logger == nil {
+		p.logger = logrus.StandardLogger()
+	}
+	if p.dialer == nil {
+		p.dialer = p
 	}
 
 	// init cert manager
-	certManager, err := cert.NewManager(conf.CertFile, conf.KeyFile)
-	if err != nil {
-		certManager = &cert.Manager{}
+	if p.certProvider == nil {
+		certManager, err := cert.NewManager(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			p.logger.Warnf("load root ca: %v, intercepted tls handshakes will fail", err)
+			certManager = &cert.Manager{}
+		}
+		p.certProvider = certManager
 	}
 
 	// init packet capture websocket
-	pcw := protocol.NewPacketCaptureWebsocket(conf.UseWebsocket)
+	if p.store == nil {
+		p.store = capture.NewStore(capture.DefaultStoreSize)
+	}
+	p.hub = capture.NewHub(capture.DefaultQueueSize, p.store)
+	p.pcw = capture.NewPacketCaptureWebsocket(p.hub, conf.UseWebsocket, p.logger)
+	p.pcs = capture.NewPacketCaptureStream(p.hub, conf.UseWebsocket)
+	// the hub stores completed flows, assigning their seq, so it goes first for the other sinks to see it
+	p.sinks = append(capture.Sinks{p.hub}, p.sinks...)
+
+	p.access = &capture.Access{
+		Token:   conf.CaptureToken,
+		Origins: conf.AllowedOrigins,
+	}
+	if len(p.access.Token) == 0 {
+		p.access.Token = capture.NewToken()
+		p.generatedToken = true
+	}
+
+	var err error
+	if p.intercept, err = intercept.New(&conf.Intercept, p.sinks, p.logger); err != nil {
+		p.logger.Warnf("intercept: %v, breakpoints time out with the default policy", err)
+		p.intercept, _ = intercept.New(&intercept.Config{Rules: conf.Intercept.Rules, Timeout: conf.Intercept.Timeout}, p.sinks, p.logger)
+	}
 
 	// register protocol handler
-	p.RegisterProtocolHandler("http", protocol.NewHTTPHandler(pcw))
-	p.RegisterProtocolHandler("https", protocol.NewTLSHandler(certManager, pcw))
+	// breakpoints run after the other addons, so they see the requests as forwarded and the responses as returned,
+	// requests answered by an addon are never paused
+	addons := slices.Concat(p.addons, addon.Chain{p.intercept.RequestAddon(), p.intercept.ResponseAddon()})
+	protocolOpts := &protocol.Options{
+		Logger:  p.logger,
+		Sink:    p.sinks,
+		Addons:  addons,
+		Offline: conf.Offline,
+	}
+	p.RegisterProtocolHandler("http", protocol.NewHTTPHandler(protocolOpts))
+	p.RegisterProtocolHandler("https", protocol.NewTLSHandler(p.certProvider, protocolOpts))
+
+	p.replayer = replay.New(p.dialer, p.sinks, p.store, p.logger)
 
 	mux := http.NewServeMux()
-	mux.Handle("/", p)
-	mux.Handle("/ws", pcw)
+	mux.Handle("/ws", p.access.Wrap(p.pcw))
+	mux.Handle("/sse", p.access.Wrap(p.pcs.Handler(capture.FormatSSE)))
+	mux.Handle("/ndjson", p.access.Wrap(p.pcs.Handler(capture.FormatNDJSON)))
+	mux.Handle("/har", p.access.Wrap(capture.HARHandler(p.store)))
+	mux.Handle("/import", p.access.Wrap(capture.ImportHandler(p.hub)))
+	mux.Handle("/replay", p.access.Wrap(p.replayer))
+	mux.Handle("/intercept", p.access.Wrap(p.intercept))
+	mux.Handle("/intercept/", p.access.Wrap(p.intercept))
+
+	if len(conf.ControlAddr) > 0 {
+		p.control = &http.Server{
+			Addr:    conf.ControlAddr,
+			Handler: mux,
+		}
+		// the control server shuts down after the proxied flows drained
+		p.control.RegisterOnShutdown(p.pcs.Close)
+		p.server.Handler = p
+		return p
+	}
 
+	// capture endpoints share the proxy port, only origin-form requests address the proxy itself,
+	// tunnels and absolute-form requests are proxied whatever their path
+	// open streams would hold up the drain, so they end once shutdown starts
+	p.server.RegisterOnShutdown(p.pcs.Close)
+	mux.Handle("/", p)
 	p.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodConnect {
+		if r.Method == http.MethodConnect || r.URL.IsAbs() {
 			p.ServeHTTP(w, r)
 			return
 		}
@@ -79,22 +228,173 @@ func New(conf *Config) *proxy {
 	return p
 }
 
-// Start is run proxy server
-func (p *proxy) Start() error {
+// Store returns the recent flows kept by the proxy
+func (p *Proxy) Store() *capture.Store {
+	return p.store
+}
+
+// Load adds flows captured elsewhere to the store and publishes them to the capture clients,
+// e.g. the flows of a HAR file read with capture.ReadFlowsFile
+func (p *Proxy) Load(flows []*model.PacketCaptureFlow) {
+	p.hub.Load(flows)
+}
+
+// Intercept returns the breakpoints, e.g. to set the rules or resolve breakpoints from the embedding program
+func (p *Proxy) Intercept() *intercept.Intercept {
+	return p.intercept
+}
+
+// CaptureToken returns the token capture clients must present
+func (p *Proxy) CaptureToken() string {
+	return p.access.Token
+}
+
+// Listen binds the proxy to Config.Addr unless it was given a listener, and the capture endpoints to Config.ControlAddr
+// Addr reports the bound address once it returns, which is useful when listening on port 0
+func (p *Proxy) Listen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.control != nil && p.controlListener == nil {
+		addr, err := netutil.LoopbackAddr(p.control.Addr)
+		if err != nil {
+			return fmt.Errorf("control addr: %w", err)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		p.controlListener = ln
+	}
+
+	if p.listener != nil {
+		return nil
+	}
+
 	ln, err := net.Listen("tcp", p.server.Addr)
 	if err != nil {
 		return err
 	}
+	p.listener = ln
+
+	return nil
+}
+
+// Addr returns the address the proxy is bound to, or nil before Listen
+func (p *Proxy) Addr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listener == nil {
+		return nil
+	}
+
+	return p.listener.Addr()
+}
+
+// ControlAddr returns the address the capture endpoints are served on, or nil before Listen
+func (p *Proxy) ControlAddr() net.Addr {
+	if p.control == nil {
+		return p.Addr()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.controlListener == nil {
+		return nil
+	}
+
+	return p.controlListener.Addr()
+}
+
+// Start is run proxy server
+// it blocks until the proxy is stopped, in which case it returns nil
+func (p *Proxy) Start() error {
+	if err := p.Listen(); err != nil {
+		return err
+	}
+
+	p.logger.Infof("Listen Addr: %s", p.Addr())
+	if p.control != nil {
+		p.logger.Infof("Control Addr: %s", p.ControlAddr())
+		go func() {
+			if err := p.control.Serve(p.controlListener); !errors.Is(err, http.ErrServerClosed) {
+				p.logger.Errorf("control server: %v", err)
+			}
+		}()
+	}
+	if p.generatedToken {
+		p.logger.Infof("Capture Token: %s", p.access.Token)
+	}
+	if err := p.server.Serve(&listener{Listener: p.listener, p: p}); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Stop stops accepting conns and drains in-flight flows until ctx is done,
+// then closes the remaining tunnels, the capture websocket clients and the sinks
+func (p *Proxy) Stop(ctx context.Context) error {
+	// paused flows would hold up the drain
+	p.intercept.Close()
+
+	var errs []error
+	if err := p.server.Shutdown(ctx); err != nil {
+		p.server.Close()
+		errs = append(errs, err)
+	}
+	if p.control != nil {
+		if err := p.control.Shutdown(ctx); err != nil {
+			p.control.Close()
+			errs = append(errs, fmt.Errorf("shutdown control server: %w", err))
+		}
+	}
+
+	for scheme, handler := range p.protocols {
+		if s, ok := handler.(protocol.Shutdowner); ok {
+			if err := s.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("shutdown %s handler: %w", scheme, err))
+			}
+		}
+	}
+
+	p.replayer.Close()
+	p.hub.Close()
+
+	p.mu.Lock()
+	conns := slices.Collect(maps.Values(p.conns))
+	p.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+
+	// last, so the sinks record the drained flows and the closed conns
+	if err := p.sinks.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("close sinks: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// emitConnEvent publishes a connection lifecycle event to the capture clients
+func (p *Proxy) emitConnEvent(event *model.ConnectionEvent) {
+	if event.Side == model.ClientSide && event.Event == model.ConnClosed {
+		p.mu.Lock()
+		delete(p.conns, event.ID)
+		p.mu.Unlock()
+	}
 
-	logrus.Infof("Listen Addr: %s", p.server.Addr)
-	return p.server.Serve(ln)
+	p.sinks.Publish(model.NewConnectionEvent(event))
 }
 
-func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get enhanced conn from context
 	enhancedConn := connection.MustGetEnhancedConnFromContext(r.Context())
 
 	if r.Method == http.MethodConnect {
+		enhancedConn.Session.Timing.ConnectReceived = time.Now()
 		if len(r.URL.Scheme) == 0 {
 			r.URL.Scheme = "https"
 		}
@@ -113,23 +413,25 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if enhancedConn.Session.Dialer == nil {
-		enhancedConn.Session.Dialer = p
+		enhancedConn.Session.Dialer = p.dialer
 	}
 
 	// handle request
 	if err := handler.Handle(w, r, enhancedConn); err != nil {
-		logrus.Errorf("Protocol handling error: %v", err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		p.logger.Errorf("Protocol handling error: %v", err)
+		if !protocol.ResponseSent(err) {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
 	}
 }
 
 // RegisterProtocolHandler registers a protocol handler for a given scheme
-func (p *proxy) RegisterProtocolHandler(scheme string, handler protocol.Handler) {
+func (p *Proxy) RegisterProtocolHandler(scheme string, handler protocol.Handler) {
 	p.protocols[scheme] = handler
 }
 
 // Dial dials a connection based on the request
-func (p *proxy) Dial(ctx context.Context, r *http.Request) (net.Conn, error) {
+func (p *Proxy) Dial(ctx context.Context, r *http.Request) (net.Conn, error) {
 	// get proxy url
 	proxyUrl, err := p.GetProxyURL(ctx, r)
 	if err != nil {
@@ -149,7 +451,7 @@ func (p *proxy) Dial(ctx context.Context, r *http.Request) (net.Conn, error) {
 	return (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", addr)
 }
 
-func (p *proxy) GetProxyURL(ctx context.Context, r *http.Request) (*url.URL, error) {
+func (p *Proxy) GetProxyURL(ctx context.Context, r *http.Request) (*url.URL, error) {
 	if len(r.URL.Scheme) == 0 {
 		r.URL.Scheme = "https"
 	}
@@ -161,3 +463,24 @@ func (p *proxy) GetProxyURL(ctx context.Context, r *http.Request) (*url.URL, err
 		},
 	})
 }
+
+// listener wraps accepted conns so the session can count bytes and report lifecycle events
+type listener struct {
+	net.Listener
+
+	p *Proxy
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	enhancedConn := connection.NewEnhancedConn(c, l.p.emitConnEvent)
+	l.p.mu.Lock()
+	l.p.conns[enhancedConn.Session.ClientConn.ID] = enhancedConn
+	l.p.mu.Unlock()
+
+	return enhancedConn, nil
+}
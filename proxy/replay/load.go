@@ -0,0 +1,336 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/model"
+)
+
+// load orders
+const (
+	// requests are sent as soon as a worker is free
+	OrderFast = "fast"
+
+	// each pass sends the flows one after another in recorded order, concurrent passes overlap
+	OrderRecorded = "recorded"
+
+	// each pass sends the flows at their recorded offsets from the first one
+	OrderTimed = "timed"
+)
+
+// LoadConfig controls a load replay, zero values send every flow once, one at a time
+type LoadConfig struct {
+	// passes over the flows
+	Count int
+
+	// requests in flight at most, or passes in flight for OrderRecorded
+	Concurrency int
+
+	// requests started per second at most, zero is unlimited
+	Rate float64
+
+	// OrderFast by default
+	Order string
+
+	// applied to every request
+	Edit *Edit
+}
+
+// Validate reports invalid settings
+func (c *LoadConfig) Validate() error {
+	switch c.Order {
+	case "", OrderFast, OrderRecorded, OrderTimed:
+	default:
+		return fmt.Errorf("unknown order %q, want %s, %s or %s", c.Order, OrderFast, OrderRecorded, OrderTimed)
+	}
+	if c.Count < 0 || c.Concurrency < 0 || c.Rate < 0 {
+		return errors.New("count, concurrency and rate must not be negative")
+	}
+	if c.Edit != nil {
+		return c.Edit.Validate()
+	}
+
+	return nil
+}
+
+// Summary reports the outcome of a load replay
+type Summary struct {
+	// requests sent, including failed ones
+	Requests int `json:"requests"`
+
+	// requests that got no response
+	Failed int `json:"failed"`
+
+	// wall time of the whole replay
+	Duration time.Duration `json:"duration"`
+
+	// response status -> count
+	Status map[int]int `json:"status"`
+
+	// error -> count
+	Errors map[string]int `json:"errors,omitempty"`
+
+	// latency of the completed responses, from sending the request to the last response byte
+	Latency Latency `json:"latency"`
+}
+
+// Latency summarizes a latency distribution
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// Load replays flows as a load test and summarizes the responses
+// the replayed flows are published to the sink, cancelling ctx stops sending and summarizes the requests sent so far
+func (r *Replayer) Load(ctx context.Context, flows []*model.PacketCaptureFlow, conf *LoadConfig) (*Summary, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	flows = slices.DeleteFunc(slices.Clone(flows), func(flow *model.PacketCaptureFlow) bool {
+		return flow.Request == nil
+	})
+	if len(flows) == 0 {
+		return nil, errors.New("no flows to replay")
+	}
+
+	count, concurrency := max(conf.Count, 1), max(conf.Concurrency, 1)
+	replayer := r.withPool(concurrency)
+	if replayer != r {
+		defer replayer.Close()
+	}
+	l := &load{
+		replayer: replayer,
+		edit:     conf.Edit,
+		pacer:    newPacer(conf.Rate),
+		summary: &Summary{
+			Status: make(map[int]int),
+			Errors: make(map[string]int),
+		},
+	}
+
+	start := time.Now()
+	switch conf.Order {
+	case OrderRecorded:
+		l.recorded(ctx, flows, count, concurrency)
+	case OrderTimed:
+		l.timed(ctx, flows, count, concurrency)
+	default:
+		l.fast(ctx, flows, count, concurrency)
+	}
+	l.summary.Duration = time.Since(start)
+	l.summary.Latency = newLatency(l.latencies)
+
+	return l.summary, nil
+}
+
+// load is the state of a running load replay
+type load struct {
+	replayer *Replayer
+	edit     *Edit
+	pacer    *pacer
+
+	mu        sync.Mutex
+	summary   *Summary
+	latencies []time.Duration
+}
+
+// fast lets the workers take the requests of all passes from one queue
+func (l *load) fast(ctx context.Context, flows []*model.PacketCaptureFlow, count, concurrency int) {
+	queue := make(chan *model.PacketCaptureFlow)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Go(func() {
+			for flow := range queue {
+				l.send(ctx, flow)
+			}
+		})
+	}
+
+feed:
+	for range count {
+		for _, flow := range flows {
+			select {
+			case queue <- flow:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// recorded runs concurrent passes, each sending the flows in order
+func (l *load) recorded(ctx context.Context, flows []*model.PacketCaptureFlow, count, concurrency int) {
+	passes := make(chan struct{})
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Go(func() {
+			for range passes {
+				for _, flow := range flows {
+					if ctx.Err() != nil {
+						break
+					}
+					l.send(ctx, flow)
+				}
+			}
+		})
+	}
+
+feed:
+	for range count {
+		select {
+		case passes <- struct{}{}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(passes)
+	wg.Wait()
+}
+
+// timed sends every flow of a pass at its recorded offset, passes follow each other
+// flows without timing keep the offset of the previous one
+func (l *load) timed(ctx context.Context, flows []*model.PacketCaptureFlow, count, concurrency int) {
+	offsets := make([]time.Duration, len(flows))
+	var first, last time.Time
+	for i, flow := range flows {
+		if flow.Timing != nil && !flow.Timing.RequestStart.IsZero() {
+			if first.IsZero() {
+				first = flow.Timing.RequestStart
+			}
+			last = flow.Timing.RequestStart
+		}
+		if !last.IsZero() {
+			offsets[i] = max(last.Sub(first), 0)
+		}
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+feed:
+	for range count {
+		passStart := time.Now()
+		for i, flow := range flows {
+			timer.Reset(time.Until(passStart.Add(offsets[i])))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				break feed
+			}
+
+			// a pass falls behind its recording when all workers are busy
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break feed
+			}
+			wg.Go(func() {
+				defer func() { <-sem }()
+				l.send(ctx, flow)
+			})
+		}
+	}
+	wg.Wait()
+}
+
+// send replays flow once it is paced and records the outcome
+func (l *load) send(ctx context.Context, original *model.PacketCaptureFlow) {
+	if err := l.pacer.wait(ctx); err != nil {
+		return
+	}
+
+	flow, err := l.replayer.Replay(ctx, original, l.edit)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.summary.Requests++
+	if err != nil {
+		l.summary.Failed++
+		l.summary.Errors[err.Error()]++
+		return
+	}
+	l.summary.Status[flow.Response.StatusCode]++
+	if t := flow.Timing; t != nil && !t.RequestStart.IsZero() && !t.ResponseComplete.IsZero() {
+		l.latencies = append(l.latencies, t.ResponseComplete.Sub(t.RequestStart))
+	}
+}
+
+func newLatency(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	slices.Sort(latencies)
+
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+
+	return Latency{
+		Min:  latencies[0],
+		Mean: total / time.Duration(len(latencies)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// pacer spaces the request starts to keep a rate
+type pacer struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newPacer(rate float64) *pacer {
+	p := &pacer{}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return p
+}
+
+// wait blocks until the next request may start
+func (p *pacer) wait(ctx context.Context) error {
+	if p.interval == 0 {
+		return ctx.Err()
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestNewLatency(t *testing.T) {
+	// 1ms to 100ms, shuffled
+	hundred := make([]time.Duration, 100)
+	for i := range hundred {
+		hundred[i] = time.Duration(i+1) * time.Millisecond
+	}
+	rand.Shuffle(len(hundred), func(i, j int) { hundred[i], hundred[j] = hundred[j], hundred[i] })
+
+	ms := func(n float64) time.Duration { return time.Duration(n * float64(time.Millisecond)) }
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		want      Latency
+	}{
+		{"none", nil, Latency{}},
+		{"one", []time.Duration{ms(7)}, Latency{Min: ms(7), Mean: ms(7), P50: ms(7), P90: ms(7), P99: ms(7), Max: ms(7)}},
+		{"two", []time.Duration{ms(30), ms(10)}, Latency{Min: ms(10), Mean: ms(20), P50: ms(10), P90: ms(10), P99: ms(10), Max: ms(30)}},
+		{"hundred", hundred, Latency{Min: ms(1), Mean: ms(50.5), P50: ms(50), P90: ms(90), P99: ms(99), Max: ms(100)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newLatency(tt.latencies); got != tt.want {
+				t.Errorf("newLatency() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := newPacer(100)
+	if p.interval != 10*time.Millisecond {
+		t.Fatalf("interval = %v, want 10ms", p.interval)
+	}
+
+	start := time.Now()
+	for range 6 {
+		if err := p.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first start is immediate
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("6 starts at 100/s took %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestPacerCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := newPacer(0).wait(ctx); err != context.Canceled {
+		t.Errorf("unpaced wait = %v, want %v", err, context.Canceled)
+	}
+	if err := newPacer(0).wait(context.Background()); err != nil {
+		t.Errorf("unpaced wait = %v, want no wait", err)
+	}
+
+	p := newPacer(0.001)
+	p.wait(context.Background())
+	start := time.Now()
+	if err := p.wait(ctx); err != context.Canceled {
+		t.Errorf("paced wait = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled wait took %v", elapsed)
+	}
+}
@@ -0,0 +1,370 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/internal/netutil"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/capture"
+	"github.com/Twacqwq/mitmfoxy/proxy/connection"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// hop-by-hop headers of the captured request, they described the client conn and are not replayed
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Edit changes a captured request before it is sent again, empty fields keep the captured value
+type Edit struct {
+	Method string `json:"method,omitempty"`
+
+	// replaces the whole url
+	URL string `json:"url,omitempty"`
+
+	// replaces the scheme and host, keeping the path and query, e.g. http://staging.internal:8080
+	Target string `json:"target,omitempty"`
+
+	// headers replacing the captured values
+	Header http.Header `json:"header,omitempty"`
+
+	// headers removed
+	DelHeader []string `json:"del_header,omitempty"`
+
+	// replaces the body
+	Body *string `json:"body,omitempty"`
+}
+
+// Validate reports malformed urls
+func (e *Edit) Validate() error {
+	for name, raw := range map[string]string{"url": e.URL, "target": e.Target} {
+		if len(raw) == 0 {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid %s %q, want an absolute http or https url", name, raw)
+		}
+	}
+
+	return nil
+}
+
+// Request selects the flows replayed through the control api, by id or by filter expression
+type Request struct {
+	// flows replayed in order
+	IDs []string `json:"ids,omitempty"`
+
+	// replays the stored flows matching the filter expression instead, see the filter package
+	Expr *filter.Expr `json:"expr,omitempty"`
+
+	Edit *Edit `json:"edit,omitempty"`
+}
+
+// Response lists the replayed flows, a failed replay is reported by the error of its flow
+type Response struct {
+	Flows []*model.PacketCaptureFlow `json:"flows"`
+}
+
+// upstream pool limits, load replays keep as many idle conns per host as they have workers
+const (
+	maxIdleConns        = 256
+	maxIdleConnsPerHost = 16
+	idleConnTimeout     = 90 * time.Second
+)
+
+// Replayer sends captured requests again through the proxy dialer
+// the replayed flows are published to the sink like proxied ones, linked to the original by ReplayOf
+type Replayer struct {
+	transport *http.Transport
+	sink      capture.Sink
+	store     *capture.Store
+	logger    logrus.FieldLogger
+}
+
+// New returns a Replayer dialing through dialer, a nil dialer dials upstream directly and a nil sink drops the flows
+func New(dialer connection.Dialer, sink capture.Sink, store *capture.Store, logger logrus.FieldLogger) *Replayer {
+	if dialer == nil {
+		dialer = directDialer{}
+	}
+	if sink == nil {
+		sink = capture.Sinks(nil)
+	}
+
+	r := &Replayer{
+		sink:   sink,
+		store:  store,
+		logger: logger,
+	}
+	r.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			req := &http.Request{
+				URL:  &url.URL{Scheme: "http", Host: addr},
+				Host: addr,
+			}
+			c, err := dialer.Dial(ctx, req.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			return &conn{Conn: c, id: uuid.NewString()}, nil
+		},
+		// upstream certificates are not verified, like for intercepted tunnels
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2:   true,
+		DisableCompression:  true,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+
+	return r
+}
+
+// withPool returns a copy of r keeping up to size idle conns per host, so concurrent workers reuse their conns
+func (r *Replayer) withPool(size int) *Replayer {
+	if size <= maxIdleConnsPerHost {
+		return r
+	}
+
+	c := *r
+	c.transport = r.transport.Clone()
+	c.transport.MaxIdleConns = max(maxIdleConns, size)
+	c.transport.MaxIdleConnsPerHost = size
+
+	return &c
+}
+
+// Replay sends the request of original again, after applying edit, and returns the new flow
+// a failed replay returns the failed flow along with the error
+func (r *Replayer) Replay(ctx context.Context, original *model.PacketCaptureFlow, edit *Edit) (*model.PacketCaptureFlow, error) {
+	if original.Request == nil {
+		return nil, fmt.Errorf("flow %s has no request", original.ID)
+	}
+
+	req, body, err := newRequest(ctx, original.Request, edit)
+	if err != nil {
+		return nil, err
+	}
+
+	timing := model.Timing{RequestStart: time.Now()}
+	flow := model.NewPacketCaptureFlow(req, nil)
+	flow.Request = model.NewRequest(req, body)
+	flow.ReplayOf = original.ID
+	r.publish(model.EventRequestStarted, flow)
+
+	var serverConn *model.ConnInfo
+	ctx = connection.WithRequestTrace(ctx, &timing)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			serverConn = connInfo(info.Conn)
+		},
+	})
+
+	resp, err := r.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return r.fail(flow, &timing, err)
+	}
+	defer resp.Body.Close()
+	flow.ServerConn = serverConn
+
+	flow.Response = model.NewResponse(resp, nil)
+	r.publish(model.EventResponseHeaders, flow)
+
+	respBody, err := io.ReadAll(resp.Body)
+	flow.Response = model.NewResponse(resp, respBody)
+	if err != nil {
+		return r.fail(flow, &timing, err)
+	}
+	timing.ResponseComplete = time.Now()
+
+	flow.Timing = &timing
+	r.publish(model.EventResponseComplete, flow)
+
+	return flow.Snapshot(), nil
+}
+
+// Close closes the idle upstream conns
+func (r *Replayer) Close() {
+	r.transport.CloseIdleConnections()
+}
+
+// ServeHTTP replays the flows selected by a posted Request and responds with the replayed flows
+func (r *Replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var replayReq Request
+	if err := json.NewDecoder(req.Body).Decode(&replayReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if replayReq.Edit != nil {
+		if err := replayReq.Edit.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	originals, err := r.selectFlows(&replayReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &Response{Flows: []*model.PacketCaptureFlow{}}
+	for _, original := range originals {
+		flow, err := r.Replay(req.Context(), original, replayReq.Edit)
+		if flow == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Flows = append(resp.Flows, flow)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// selectFlows looks up the stored flows selected by req
+func (r *Replayer) selectFlows(req *Request) ([]*model.PacketCaptureFlow, error) {
+	if len(req.IDs) > 0 {
+		flows := make([]*model.PacketCaptureFlow, 0, len(req.IDs))
+		for _, id := range req.IDs {
+			flow, ok := r.store.Get(id)
+			if !ok {
+				return nil, fmt.Errorf("flow %q is not stored", id)
+			}
+			flows = append(flows, flow)
+		}
+		return flows, nil
+	}
+
+	if req.Expr.Empty() {
+		return nil, errors.New("select the flows to replay by ids or expr")
+	}
+
+	return slices.DeleteFunc(r.store.Flows(), func(flow *model.PacketCaptureFlow) bool {
+		return !req.Expr.Match(flow)
+	}), nil
+}
+
+func (r *Replayer) publish(typ string, flow *model.PacketCaptureFlow) {
+	r.sink.Publish(model.NewFlowEvent(typ, flow.Snapshot()))
+}
+
+func (r *Replayer) fail(flow *model.PacketCaptureFlow, timing *model.Timing, err error) (*model.PacketCaptureFlow, error) {
+	flow.Error = err.Error()
+	flow.Timing = timing
+	r.publish(model.EventFlowError, flow)
+
+	return flow.Snapshot(), err
+}
+
+// newRequest rebuilds a captured request with edit applied, returning its body
+func newRequest(ctx context.Context, captured *model.Request, edit *Edit) (*http.Request, []byte, error) {
+	method, rawURL, body := captured.Method, captured.Url, captured.Body
+	header := captured.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	if edit == nil {
+		edit = &Edit{}
+	}
+	if len(edit.Method) > 0 {
+		method = edit.Method
+	}
+	if len(edit.URL) > 0 {
+		rawURL = edit.URL
+	}
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+	}
+	for name, values := range edit.Header {
+		header[http.CanonicalHeaderKey(name)] = values
+	}
+	for _, name := range edit.DelHeader {
+		header.Del(name)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(edit.Target) > 0 {
+		target, err := url.Parse(edit.Target)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.Scheme, u.Host = target.Scheme, target.Host
+	}
+	if !u.IsAbs() || len(u.Host) == 0 {
+		return nil, nil, fmt.Errorf("can not replay to %q, the url is not absolute", u)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	header.Del("Content-Length")
+	req.Header = header
+
+	return req, body, nil
+}
+
+// directDialer dials upstream without the proxy, for replays run outside of it
+type directDialer struct{}
+
+func (directDialer) Dial(ctx context.Context, r *http.Request) (net.Conn, error) {
+	return (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", netutil.JoinHostPort(r.URL))
+}
+
+// conn identifies the upstream conns of replays
+type conn struct {
+	net.Conn
+
+	id string
+}
+
+func connInfo(c net.Conn) *model.ConnInfo {
+	info := &model.ConnInfo{
+		RemoteAddr: c.RemoteAddr().String(),
+		LocalAddr:  c.LocalAddr().String(),
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		info.TLS = true
+		c = tlsConn.NetConn()
+	}
+	if rc, ok := c.(*conn); ok {
+		info.ID = rc.id
+	}
+
+	return info
+}
@@ -0,0 +1,346 @@
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Twacqwq/mitmfoxy/filter"
+	"github.com/Twacqwq/mitmfoxy/model"
+	"github.com/Twacqwq/mitmfoxy/proxy/addon"
+	"github.com/sirupsen/logrus"
+)
+
+// rule phases
+const (
+	// rewrite the request before it is forwarded upstream
+	PhaseRequest = "request"
+
+	// rewrite the response before it is returned to the client
+	PhaseResponse = "response"
+)
+
+// Rule rewrites the requests or responses of the flows matching Filter
+// headers are removed, then set, then appended, the body replacements run in order
+type Rule struct {
+	// PhaseRequest or PhaseResponse
+	Phase string `json:"phase"`
+
+	// flows the rule applies to, empty matches every flow
+	// the body is only matched by rules replacing in it, so other rules do not buffer streamed bodies,
+	// and only buffered when the headers may match
+	Filter *filter.Expr `json:"filter,omitempty"`
+
+	RemoveHeader []string          `json:"remove_header,omitempty"`
+	SetHeader    map[string]string `json:"set_header,omitempty"`
+	AppendHeader map[string]string `json:"append_header,omitempty"`
+
+	// query parameters set or removed, in the request phase only
+	SetQuery    map[string]string `json:"set_query,omitempty"`
+	RemoveQuery []string          `json:"remove_query,omitempty"`
+
+	// regexp replacements in the decoded body, the body is encoded again as it was,
+	// the rule is skipped for bodies larger than 16MB
+	// in the response phase the requests only accept the gzip and deflate encodings, which are supported
+	ReplaceBody []Replace `json:"replace_body,omitempty"`
+}
+
+// Replace replaces the matches of Pattern, Replacement may refer to groups, e.g. $1
+type Replace struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// File is a rewrite config file
+type File struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ReadFile reads the rules of a json config file
+func ReadFile(name string) ([]Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file File
+	dec := json.NewDecoder(f)
+	// misspelled fields would silently do nothing
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+
+	return file.Rules, nil
+}
+
+// Rewrite applies its rules to the matching flows
+type Rewrite struct {
+	request, response []*rule
+	logger            logrus.FieldLogger
+
+	// a response rule replaces in bodies
+	replaceResponse bool
+}
+
+type rule struct {
+	Rule
+
+	// compiled ReplaceBody patterns
+	replace []*regexp.Regexp
+}
+
+func New(rules []Rule, logger logrus.FieldLogger) (*Rewrite, error) {
+	rw := &Rewrite{logger: logger}
+	for i, r := range rules {
+		compiled := &rule{Rule: r}
+		for _, replace := range r.ReplaceBody {
+			re, err := regexp.Compile(replace.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i+1, replace.Pattern, err)
+			}
+			compiled.replace = append(compiled.replace, re)
+		}
+
+		switch r.Phase {
+		case PhaseRequest:
+			rw.request = append(rw.request, compiled)
+		case PhaseResponse:
+			if len(r.SetQuery) > 0 || len(r.RemoveQuery) > 0 {
+				return nil, fmt.Errorf("rule %d: query parameters are only rewritten in the %s phase", i+1, PhaseRequest)
+			}
+			rw.response = append(rw.response, compiled)
+			rw.replaceResponse = rw.replaceResponse || len(compiled.replace) > 0
+		default:
+			return nil, fmt.Errorf("rule %d: invalid phase %q, want %s or %s", i+1, r.Phase, PhaseRequest, PhaseResponse)
+		}
+	}
+
+	return rw, nil
+}
+
+func (rw *Rewrite) Request(r *http.Request) (*http.Response, error) {
+	// before the rules, so they can still set it
+	if rw.replaceResponse {
+		acceptEncoding(r.Header)
+	}
+
+	var body bufferedBody
+	flow := func() *model.PacketCaptureFlow {
+		return &model.PacketCaptureFlow{
+			ID:      addon.FlowID(r),
+			Request: model.NewRequest(r, body.data),
+		}
+	}
+	for _, rule := range rw.request {
+		replace := len(rule.replace) > 0
+		if replace {
+			ok, err := rw.buffer(&body, &r.Body, r, rule, flow)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if !rule.Filter.Match(flow()) {
+			continue
+		}
+
+		rewriteHeader(r.Header, &rule.Rule)
+		if len(rule.SetQuery) > 0 || len(rule.RemoveQuery) > 0 {
+			r.URL.RawQuery = rewriteQuery(r.URL.RawQuery, rule.SetQuery, rule.RemoveQuery)
+		}
+		if replace {
+			rewritten, ok := rw.replaceBody(r.Header, body.data, rule)
+			if !ok {
+				continue
+			}
+			body.data = rewritten
+			r.Body = io.NopCloser(bytes.NewReader(rewritten))
+			r.ContentLength = int64(len(rewritten))
+			if len(r.Header.Get("Content-Length")) > 0 {
+				r.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (rw *Rewrite) Response(r *http.Request, resp *http.Response) (*http.Response, error) {
+	var body bufferedBody
+	flow := func() *model.PacketCaptureFlow {
+		return &model.PacketCaptureFlow{
+			ID:       addon.FlowID(r),
+			Request:  model.NewRequest(r, nil),
+			Response: model.NewResponse(resp, body.data),
+		}
+	}
+	streaming := addon.Streaming(resp)
+	for _, rule := range rw.response {
+		replace := len(rule.replace) > 0 && !streaming
+		if replace {
+			ok, err := rw.buffer(&body, &resp.Body, r, rule, flow)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if !rule.Filter.Match(flow()) {
+			continue
+		}
+
+		rewriteHeader(resp.Header, &rule.Rule)
+		if replace {
+			rewritten, ok := rw.replaceBody(resp.Header, body.data, rule)
+			if !ok {
+				continue
+			}
+			body.data = rewritten
+			resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+			resp.ContentLength = int64(len(rewritten))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+		}
+	}
+
+	return resp, nil
+}
+
+// bufferedBody is the request or response body the replacing rules share
+type bufferedBody struct {
+	data           []byte
+	read, tooLarge bool
+}
+
+// buffer reads the body for a replacing rule and reports whether the rule may apply to it
+// the body is read once, for the first replacing rule that may match on the headers,
+// so bodies no rule replaces in stay streaming, as do bodies larger than addon.MaxBodySize, whose rules are skipped
+func (rw *Rewrite) buffer(body *bufferedBody, rc *io.ReadCloser, r *http.Request, rule *rule, flow func() *model.PacketCaptureFlow) (bool, error) {
+	if !body.read {
+		if !rule.Filter.MayMatch(flow()) {
+			return false, nil
+		}
+		data, ok, err := addon.ReadBody(rc, addon.MaxBodySize)
+		if err != nil {
+			return false, err
+		}
+		body.data, body.read, body.tooLarge = data, true, !ok
+		if !ok {
+			rw.logger.Warnf("rewrite: skip body of %s %s, larger than %d bytes", r.Method, r.URL, addon.MaxBodySize)
+		}
+	}
+
+	return !body.tooLarge, nil
+}
+
+// replaceBody runs the replacements of rule on the decoded body and encodes it again,
+// bodies in unsupported encodings are left as they are
+func (rw *Rewrite) replaceBody(header http.Header, body []byte, rule *rule) ([]byte, bool) {
+	decoded, err := model.DecodeBody(header, body)
+	if err != nil {
+		rw.logger.Warnf("rewrite: skip body: %v", err)
+		return nil, false
+	}
+
+	for i, re := range rule.replace {
+		decoded = re.ReplaceAll(decoded, []byte(rule.ReplaceBody[i].Replacement))
+	}
+
+	encoded, err := model.EncodeBody(header, decoded)
+	if err != nil {
+		rw.logger.Warnf("rewrite: skip body: %v", err)
+		return nil, false
+	}
+
+	return encoded, true
+}
+
+// acceptEncoding keeps the codings of Accept-Encoding the response bodies can be replaced in,
+// so upstream does not answer e.g. br or zstd, which would be returned unchanged
+func acceptEncoding(header http.Header) {
+	values := header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return
+	}
+
+	var codings []string
+	for _, v := range values {
+		for c := range strings.SplitSeq(v, ",") {
+			c = strings.TrimSpace(c)
+			name, _, _ := strings.Cut(c, ";")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip", "deflate", "identity":
+				codings = append(codings, c)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		codings = []string{"identity"}
+	}
+	header.Set("Accept-Encoding", strings.Join(codings, ", "))
+}
+
+// rewriteHeader removes, sets and appends the headers of rule
+func rewriteHeader(header http.Header, rule *Rule) {
+	for _, name := range rule.RemoveHeader {
+		header.Del(name)
+	}
+	for name, value := range rule.SetHeader {
+		header.Set(name, value)
+	}
+	for name, value := range rule.AppendHeader {
+		header.Add(name, value)
+	}
+}
+
+// rewriteQuery sets and removes query parameters, keeping the order and encoding of the others
+func rewriteQuery(rawQuery string, set map[string]string, remove []string) string {
+	var (
+		params []string
+		done   = make(map[string]bool)
+	)
+	for param := range strings.SplitSeq(rawQuery, "&") {
+		if len(param) == 0 {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if slices.Contains(remove, key) || done[key] {
+			continue
+		}
+		if value, ok := set[key]; ok {
+			// repeated parameters collapse into the set value
+			param = url.QueryEscape(key) + "=" + url.QueryEscape(value)
+			done[key] = true
+		}
+		params = append(params, param)
+	}
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		if !done[key] {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(set[key]))
+	}
+
+	return strings.Join(params, "&")
+}
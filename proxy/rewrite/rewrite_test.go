@@ -0,0 +1,62 @@
+package rewrite
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		set    map[string]string
+		remove []string
+		want   string
+	}{
+		{"unchanged", "b=2&a=1", nil, nil, "b=2&a=1"},
+		{"keeps the encoding", "q=a%20b&x=%2F", nil, nil, "q=a%20b&x=%2F"},
+		{"empty params dropped", "a=1&&b=2&", nil, nil, "a=1&b=2"},
+		{"set in place", "a=1&b=2&c=3", map[string]string{"b": "x y"}, nil, "a=1&b=x+y&c=3"},
+		{"set new sorted", "a=1", map[string]string{"z": "1", "m": "2"}, nil, "a=1&m=2&z=1"},
+		{"set collapses repeats", "a=1&a=2&b=3", map[string]string{"a": "x"}, nil, "a=x&b=3"},
+		{"remove", "a=1&b=2&a=3", nil, []string{"a"}, "b=2"},
+		{"remove escaped key", "a%20b=1&c=2", nil, []string{"a b"}, "c=2"},
+		{"flag params", "debug&a=1", map[string]string{"debug": "1"}, nil, "debug=1&a=1"},
+		{"empty query", "", map[string]string{"a": "1"}, nil, "a=1"},
+		{"removed then set", "a=1", map[string]string{"a": "2"}, []string{"a"}, "a=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteQuery(tt.query, tt.set, tt.remove); got != tt.want {
+				t.Errorf("rewriteQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"gzip, deflate, br, zstd"}, "gzip, deflate"},
+		{[]string{"br;q=1.0, gzip;q=0.8"}, "gzip;q=0.8"},
+		{[]string{"br", "x-gzip"}, "x-gzip"},
+		{[]string{"GZIP"}, "GZIP"},
+		{[]string{"br, zstd"}, "identity"},
+		{[]string{"identity"}, "identity"},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		for _, v := range tt.values {
+			header.Add("Accept-Encoding", v)
+		}
+		acceptEncoding(header)
+		if got := header.Get("Accept-Encoding"); got != tt.want || len(header.Values("Accept-Encoding")) > 1 {
+			t.Errorf("acceptEncoding(%q) = %q, want %q", tt.values, header.Values("Accept-Encoding"), tt.want)
+		}
+	}
+}